@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/log15"
+)
+
+type adminTeam struct {
+	AskgodID            int64  `json:"askgod_id"`
+	AskgodName          string `json:"askgod_name"`
+	DiscourseName       string `json:"discourse_name"`
+	DiscourseGroupID    int64  `json:"discourse_group_id"`
+	DiscourseCategoryID int64  `json:"discourse_category_id"`
+	Archived            bool   `json:"archived"`
+}
+
+type adminPost struct {
+	Name        string    `json:"name"`
+	DiscourseID []int64   `json:"discourse_ids"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (s *syncer) setupAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/teams", s.adminAuth(s.adminTeams))
+	mux.HandleFunc("/admin/teams/", s.adminAuth(s.adminTeamPosts))
+	mux.HandleFunc("/admin/sync/teams", s.adminAuth(s.adminSyncTeams))
+	mux.HandleFunc("/admin/sync/posts", s.adminAuth(s.adminSyncPosts))
+	mux.HandleFunc("/admin/users/approve", s.adminAuth(s.adminApproveUsers))
+}
+
+// adminAuth only lets requests with the configured bearer token through.
+func (s *syncer) adminAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if token == header || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) != 1 {
+			s.logger.Warn("Rejected unauthenticated admin request", log15.Ctx{"remote": r.RemoteAddr, "path": r.URL.Path})
+			httpError(w, http.StatusUnauthorized, fmt.Errorf("Invalid token"))
+			return
+		}
+
+		s.logger.Info("Processing admin request", log15.Ctx{"remote": r.RemoteAddr, "method": r.Method, "path": r.URL.Path})
+		handler(w, r)
+	}
+}
+
+// GET /admin/teams
+func (s *syncer) adminTeams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method not allowed"))
+		return
+	}
+
+	dbTeams, err := s.dbGetTeams()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	teams := []adminTeam{}
+	for _, team := range dbTeams {
+		teams = append(teams, adminTeam{
+			AskgodID:            team.AskgodID,
+			AskgodName:          team.AskgodName,
+			DiscourseName:       team.DiscourseName,
+			DiscourseGroupID:    team.DiscourseGroupID,
+			DiscourseCategoryID: team.DiscourseCategoryID,
+			Archived:            team.Archived,
+		})
+	}
+
+	httpJSON(w, teams)
+}
+
+// GET /admin/teams/<askgod id>/posts
+// POST|DELETE /admin/teams/<askgod id>/posts/<name>
+func (s *syncer) adminTeamPosts(w http.ResponseWriter, r *http.Request) {
+	fields := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/teams/"), "/")
+	if len(fields) < 2 || len(fields) > 3 || fields[1] != "posts" {
+		httpError(w, http.StatusNotFound, fmt.Errorf("Not found"))
+		return
+	}
+
+	askgodID, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("Invalid team ID: %s", fields[0]))
+		return
+	}
+
+	// Listing of the published posts
+	if len(fields) == 2 {
+		if r.Method != "GET" {
+			httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method not allowed"))
+			return
+		}
+
+		posts, err := s.adminGetTeamPosts(askgodID)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		httpJSON(w, posts)
+		return
+	}
+
+	// Actions on a single post
+	ctx := r.Context()
+	if r.Method == "POST" {
+		err = s.adminPublishPost(ctx, askgodID, fields[2])
+	} else if r.Method == "DELETE" {
+		err = s.adminRetractPost(ctx, askgodID, fields[2])
+	} else {
+		httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method not allowed"))
+		return
+	}
+
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	httpJSON(w, nil)
+}
+
+// POST /admin/sync/teams
+func (s *syncer) adminSyncTeams(w http.ResponseWriter, r *http.Request) {
+	s.adminRun(w, r, s.syncTeams)
+}
+
+// POST /admin/sync/posts
+func (s *syncer) adminSyncPosts(w http.ResponseWriter, r *http.Request) {
+	s.adminRun(w, r, s.syncPosts)
+}
+
+// POST /admin/users/approve
+func (s *syncer) adminApproveUsers(w http.ResponseWriter, r *http.Request) {
+	s.adminRun(w, r, s.discourseProcessNewUsers)
+}
+
+func (s *syncer) adminRun(w http.ResponseWriter, r *http.Request, action func(ctx context.Context) error) {
+	if r.Method != "POST" {
+		httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method not allowed"))
+		return
+	}
+
+	err := action(r.Context())
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	httpJSON(w, nil)
+}
+
+func (s *syncer) adminGetTeamPosts(askgodID int64) ([]adminPost, error) {
+	dbTeamPosts, err := s.dbGetTeamPosts()
+	if err != nil {
+		return nil, err
+	}
+
+	dbTeamPostTimes, err := s.dbGetTeamPostTimes()
+	if err != nil {
+		return nil, err
+	}
+
+	posts := []adminPost{}
+	for name, ids := range dbTeamPosts[askgodID] {
+		posts = append(posts, adminPost{Name: name, DiscourseID: ids, CreatedAt: dbTeamPostTimes[askgodID][name]})
+	}
+
+	sort.Slice(posts, func(i, j int) bool { return posts[i].Name < posts[j].Name })
+
+	return posts, nil
+}
+
+// adminGetTeam returns the team if it can receive posts.
+func (s *syncer) adminGetTeam(askgodID int64) (*dbTeam, error) {
+	dbTeams, err := s.dbGetTeams()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, team := range dbTeams {
+		if team.AskgodID != askgodID {
+			continue
+		}
+
+		if !team.provisioned() || team.Archived {
+			return nil, fmt.Errorf("Team %d isn't active", askgodID)
+		}
+
+		return &team, nil
+	}
+
+	return nil, fmt.Errorf("Team %d doesn't exist", askgodID)
+}
+
+func (s *syncer) adminPublishPost(ctx context.Context, askgodID int64, name string) error {
+	s.postsLock.Lock()
+	defer s.postsLock.Unlock()
+
+	team, err := s.adminGetTeam(askgodID)
+	if err != nil {
+		return err
+	}
+
+	posts, err := s.loadPosts()
+	if err != nil {
+		return err
+	}
+
+	post, ok := posts[name]
+	if !ok {
+		return fmt.Errorf("Post %s doesn't exist", name)
+	}
+
+	// An interrupted publication may already have put it on discourse
+	unresolvedIntents, err := s.syncIntents(ctx)
+	if err != nil {
+		return err
+	}
+
+	if unresolvedIntents[askgodID][name] {
+		return fmt.Errorf("Post %s may already be published for team %d, try again later", name, askgodID)
+	}
+
+	dbTeamPosts, err := s.dbGetTeamPosts()
+	if err != nil {
+		return err
+	}
+
+	_, ok = dbTeamPosts[askgodID][name]
+	if ok {
+		return fmt.Errorf("Post %s was already published for team %d", name, askgodID)
+	}
+
+	topicIDs := dbTeamPosts[askgodID][post.Topic]
+	if post.Type != "topic" && len(topicIDs) == 0 {
+		return fmt.Errorf("Topic %s wasn't published for team %d", post.Topic, askgodID)
+	}
+
+	// Data needed to render the post
+	scores, ranks, err := s.askgodGetTeamScores(ctx)
+	if err != nil {
+		return err
+	}
+
+	state := triggerState{
+		scores: scores,
+		ranks:  ranks,
+	}
+
+	apiUser := s.config.DiscourseAPIUser
+	apiKey := s.config.DiscourseAPIKey
+	if post.API != nil {
+		apiUser = post.API.User
+		apiKey = post.API.Key
+	}
+
+	err = s.publishEntry(ctx, *team, name, post, apiUser, apiKey, topicIDs, &state)
+	if err != nil {
+		return err
+	}
+
+	// Keep it published regardless of its trigger, lifting any earlier retraction
+	err = s.dbCreateOverride(askgodID, name)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("Published post on request", log15.Ctx{"team": team.DiscourseName, "name": name})
+	return nil
+}
+
+func (s *syncer) adminRetractPost(ctx context.Context, askgodID int64, name string) error {
+	s.postsLock.Lock()
+	defer s.postsLock.Unlock()
+
+	team, err := s.adminGetTeam(askgodID)
+	if err != nil {
+		return err
+	}
+
+	posts, err := s.loadPosts()
+	if err != nil {
+		return err
+	}
+
+	post, ok := posts[name]
+	if !ok {
+		return fmt.Errorf("Post %s doesn't exist", name)
+	}
+
+	dbTeamPosts, err := s.dbGetTeamPosts()
+	if err != nil {
+		return err
+	}
+
+	// Don't publish it again on the next sync
+	err = s.dbCreateRetraction(askgodID, name)
+	if err != nil {
+		return err
+	}
+
+	postIDs, ok := dbTeamPosts[askgodID][name]
+	if !ok {
+		return nil
+	}
+
+	return s.retractEntry(ctx, *team, name, post, postIDs, posts)
+}
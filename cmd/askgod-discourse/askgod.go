@@ -1,18 +1,22 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/inconshreveable/log15"
 	"github.com/nsec/askgod/api"
 )
 
-func (s *syncer) askgodGetTeams() ([]api.AdminTeam, error) {
+func (s *syncer) askgodGetTeams(ctx context.Context) ([]api.AdminTeam, error) {
 	// Grab all the teams from askgod
 	teams := []api.AdminTeam{}
-	err := s.queryStruct("askgod", "GET", "/teams", nil, &teams, nil)
+	err := s.queryStruct(ctx, "askgod", "GET", "/teams", nil, &teams, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -20,33 +24,33 @@ func (s *syncer) askgodGetTeams() ([]api.AdminTeam, error) {
 	return teams, nil
 }
 
-func (s *syncer) askgodGetTeamDiscourseFlags() (map[string][]int64, error) {
+func (s *syncer) askgodGetTeamDiscourseFlags(ctx context.Context) (map[string]map[int64]time.Time, error) {
 	// Get all the flags
 	flags := []api.AdminFlag{}
-	err := s.queryStruct("askgod", "GET", "/flags", nil, &flags, nil)
+	err := s.queryStruct(ctx, "askgod", "GET", "/flags", nil, &flags, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	// Get all the scores
 	scores := []api.AdminScore{}
-	err = s.queryStruct("askgod", "GET", "/scores", nil, &scores, nil)
+	err = s.queryStruct(ctx, "askgod", "GET", "/scores", nil, &scores, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	// Generate the output
-	resp := map[string][]int64{}
+	// Generate the output (tag to team to submission time)
+	resp := map[string]map[int64]time.Time{}
 
 	for _, flag := range flags {
 		if flag.Tags["discourse"] == "" {
 			continue
 		}
 
-		teams := []int64{}
+		teams := map[int64]time.Time{}
 		for _, score := range scores {
 			if score.FlagID == flag.ID {
-				teams = append(teams, score.TeamID)
+				teams[score.TeamID] = score.SubmitTime
 			}
 		}
 
@@ -56,12 +60,12 @@ func (s *syncer) askgodGetTeamDiscourseFlags() (map[string][]int64, error) {
 	return resp, nil
 }
 
-func (s *syncer) askgodGetTeamScores() (map[int64]int64, error) {
+func (s *syncer) askgodGetTeamScores(ctx context.Context) (map[int64]int64, map[int64]int64, error) {
 	// Grab the scoreboard
 	board := []api.ScoreboardEntry{}
-	err := s.queryStruct("askgod", "GET", "/scoreboard", nil, &board, nil)
+	err := s.queryStruct(ctx, "askgod", "GET", "/scoreboard", nil, &board, nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	teams := map[int64]int64{}
@@ -69,22 +73,139 @@ func (s *syncer) askgodGetTeamScores() (map[int64]int64, error) {
 		teams[entry.Team.ID] = entry.Value
 	}
 
-	return teams, nil
+	return teams, scoreboardRanks(board), nil
 }
 
-func (s *syncer) askgodTeamForIP(ipStr string) (*api.AdminTeam, error) {
+// scoreboardRanks computes the rank of each team, teams with the same score share a rank.
+func scoreboardRanks(board []api.ScoreboardEntry) map[int64]int64 {
+	// Sort a copy by score, highest first
+	sorted := make([]api.ScoreboardEntry, len(board))
+	copy(sorted, board)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Value > sorted[j].Value
+	})
+
+	ranks := map[int64]int64{}
+	for i, entry := range sorted {
+		if i > 0 && entry.Value == sorted[i-1].Value {
+			ranks[entry.Team.ID] = ranks[sorted[i-1].Team.ID]
+			continue
+		}
+
+		ranks[entry.Team.ID] = int64(i + 1)
+	}
+
+	return ranks
+}
+
+func (s *syncer) askgodTeamForUser(user discourseUser, teams []api.AdminTeam) (*api.AdminTeam, error) {
+	errs := []string{}
+
+	// Try each strategy in order
+	for _, strategy := range s.config.Membership {
+		var team *api.AdminTeam
+		var err error
+
+		if strategy == "subnet" {
+			team, err = s.askgodTeamForIP(user.RegistrationIPAddress, teams)
+		} else if strategy == "invite" {
+			team, err = s.askgodTeamForInvite(user.UserFields[s.config.MembershipInviteField], teams)
+		} else if strategy == "email" {
+			team, err = s.askgodTeamForEmail(user.Email, teams)
+		} else if strategy == "username" {
+			team, err = s.askgodTeamForUsername(user.Username, teams)
+		}
+
+		if err == nil {
+			return team, nil
+		}
+
+		errs = append(errs, err.Error())
+	}
+
+	return nil, fmt.Errorf("%s", strings.Join(errs, ", "))
+}
+
+// teamMemberLimit returns the maximum number of forum accounts for a team (0 for no limit).
+func (s *syncer) teamMemberLimit(team api.AdminTeam) int64 {
+	value, ok := team.Tags["discourse_max_members"]
+	if !ok {
+		return s.config.MaxMembersPerTeam
+	}
+
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		s.logger.Error("Invalid member limit for team", log15.Ctx{"team": team.Tags["discourse"], "value": value})
+		return s.config.MaxMembersPerTeam
+	}
+
+	return limit
+}
+
+// askgodTagContains checks a comma separated team tag for a value.
+func askgodTagContains(team api.AdminTeam, tag string, value string) bool {
+	for _, entry := range strings.Split(team.Tags[tag], ",") {
+		entry = strings.TrimSpace(entry)
+		if entry != "" && strings.EqualFold(entry, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *syncer) askgodTeamForInvite(code string, teams []api.AdminTeam) (*api.AdminTeam, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return nil, fmt.Errorf("No invite code provided")
+	}
+
+	// Iterate for one that matches the code
+	for _, team := range teams {
+		if team.Tags["discourse_invite"] != "" && team.Tags["discourse_invite"] == code {
+			return &team, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No team matches the invite code")
+}
+
+func (s *syncer) askgodTeamForEmail(email string, teams []api.AdminTeam) (*api.AdminTeam, error) {
+	// Extract the domain
+	fields := strings.Split(email, "@")
+	if len(fields) != 2 || fields[1] == "" {
+		return nil, fmt.Errorf("Bad email: %s", email)
+	}
+
+	// Iterate for one that matches the domain
+	for _, team := range teams {
+		if askgodTagContains(team, "discourse_domains", fields[1]) {
+			return &team, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No team matches the email domain")
+}
+
+func (s *syncer) askgodTeamForUsername(username string, teams []api.AdminTeam) (*api.AdminTeam, error) {
+	// Iterate for one that lists the user
+	for _, team := range teams {
+		if askgodTagContains(team, "discourse_users", username) {
+			return &team, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No team lists the username")
+}
+
+func (s *syncer) askgodTeamForIP(ipStr string, teams []api.AdminTeam) (*api.AdminTeam, error) {
 	// Parse the IP
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
 		return nil, fmt.Errorf("Bad IP: %s", ipStr)
 	}
 
-	// Get all the teams
-	teams, err := s.askgodGetTeams()
-	if err != nil {
-		return nil, err
-	}
-
 	// Iterate for one that matches the IP
 	for _, team := range teams {
 		if team.Subnets == "" {
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nsec/askgod/api"
+)
+
+func TestScoreboardRanks(t *testing.T) {
+	entry := func(id int64, value int64) api.ScoreboardEntry {
+		return api.ScoreboardEntry{Team: api.Team{ID: id}, Value: value}
+	}
+
+	tests := []struct {
+		name  string
+		board []api.ScoreboardEntry
+		ranks map[int64]int64
+	}{
+		{"empty", nil, map[int64]int64{}},
+		{"distinct scores", []api.ScoreboardEntry{entry(1, 100), entry(2, 300), entry(3, 200)}, map[int64]int64{1: 3, 2: 1, 3: 2}},
+		{"tie for first", []api.ScoreboardEntry{entry(1, 300), entry(2, 300), entry(3, 200)}, map[int64]int64{1: 1, 2: 1, 3: 3}},
+		{"tie in the middle", []api.ScoreboardEntry{entry(1, 300), entry(2, 200), entry(3, 200), entry(4, 100)}, map[int64]int64{1: 1, 2: 2, 3: 2, 4: 4}},
+		{"all tied", []api.ScoreboardEntry{entry(1, 0), entry(2, 0)}, map[int64]int64{1: 1, 2: 1}},
+	}
+
+	for _, test := range tests {
+		ranks := scoreboardRanks(test.board)
+		if len(ranks) != len(test.ranks) {
+			t.Errorf("%s: expected %d ranks, got %v", test.name, len(test.ranks), ranks)
+			continue
+		}
+
+		for id, rank := range test.ranks {
+			if ranks[id] != rank {
+				t.Errorf("%s: expected rank %d for team %d, got %d", test.name, rank, id, ranks[id])
+			}
+		}
+	}
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/inconshreveable/log15"
 	"github.com/urfave/cli/v2"
 )
 
@@ -18,56 +24,138 @@ func cmdDaemon(ctx *cli.Context) error {
 		return err
 	}
 
+	// Stop on SIGINT/SIGTERM
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// API requests are only aborted once the in-flight syncs were given time to finish
+	queryCtx, cancelQueries := context.WithCancel(context.Background())
+	defer cancelQueries()
+
 	// Connect to the DB
 	err = s.dbSetup()
 	if err != nil {
 		return err
 	}
 
+	// From now on, everything goes through a clean shutdown
+	fail := func(err error) error {
+		stop()
+		s.shutdown(cancelQueries)
+		return err
+	}
+
 	// Setup event handlers
 	s.logger.Info("Setting up events")
-	chEvents, err := s.setupEvents()
+	chEvents, err := s.setupEvents(sigCtx, queryCtx)
 	if err != nil {
-		return err
+		return fail(err)
 	}
 
 	// Setup timers
 	s.logger.Info("Setting up timers")
-	chTimers, err := s.setupTimers()
+	chTimers, err := s.setupTimers(sigCtx, queryCtx)
 	if err != nil {
-		return err
+		return fail(err)
 	}
 
-	// Process backlog
-	s.logger.Info("Running initial team sync")
-	err = s.syncTeams()
+	// Setup HTTP server
+	chHTTP, err := s.setupHTTP(queryCtx)
 	if err != nil {
+		return fail(err)
+	}
+
+	// Process backlog, in the background so signals are handled meanwhile
+	chInit := make(chan error, 1)
+	go func() {
+		chInit <- s.initialSync(sigCtx, queryCtx)
+	}()
+
+	// Wait for something to fail or a signal
+	for {
+		select {
+		case err = <-chInit:
+			if err != nil {
+				return fail(err)
+			}
+
+			if sigCtx.Err() == nil {
+				s.setReady()
+			}
+
+			continue
+		case err = <-chEvents:
+		case err = <-chTimers:
+		case err = <-chHTTP:
+		case <-sigCtx.Done():
+			s.logger.Info("Received signal, shutting down")
+		}
+
+		return fail(err)
+	}
+}
+
+// initialSync catches up with what happened while the daemon wasn't running,
+// stopping early once ctx is cancelled.
+func (s *syncer) initialSync(ctx context.Context, queryCtx context.Context) error {
+	s.logger.Info("Running initial team sync")
+	err := s.syncTeams(queryCtx)
+	if err != nil || ctx.Err() != nil {
 		return err
 	}
 
 	s.logger.Info("Running initial posts sync")
-	err = s.syncPosts()
-	if err != nil {
+	err = s.syncPosts(queryCtx)
+	if err != nil || ctx.Err() != nil {
 		return err
 	}
 
 	s.logger.Info("Running initial account approval")
-	err = s.discourseProcessNewUsers()
+	err = s.discourseProcessNewUsers(queryCtx)
 	if err != nil {
 		return err
 	}
 
-	// Wait for something to fail
-	select {
-	case err := <-chEvents:
-		if err != nil {
-			return err
-		}
-	case err := <-chTimers:
+	return nil
+}
+
+// shutdown waits for the in-flight syncs to complete and releases all resources.
+func (s *syncer) shutdown(cancelQueries context.CancelFunc) {
+	// Stop serving HTTP requests, letting the current ones complete
+	for _, server := range s.httpServers {
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+		err := server.Shutdown(ctx)
+		cancel()
 		if err != nil {
-			return err
+			s.logger.Warn("Failed to stop the HTTP server", log15.Ctx{"address": server.Addr, "error": err})
 		}
 	}
 
-	return nil
+	// Wait for the running syncs, holding the locks so none start afterwards
+	idle := make(chan struct{})
+	go func() {
+		// Webhooks may be waiting on the users lock, let them through first
+		s.webhooks.Wait()
+
+		s.teamsLock.Lock()
+		s.postsLock.Lock()
+		s.usersLock.Lock()
+		close(idle)
+	}()
+
+	select {
+	case <-idle:
+	case <-time.After(s.config.ShutdownTimeout):
+		s.logger.Warn("Timed out waiting for the running syncs, aborting them", log15.Ctx{"timeout": s.config.ShutdownTimeout})
+		cancelQueries()
+		<-idle
+	}
+
+	// Close the database
+	err := s.db.Close()
+	if err != nil {
+		s.logger.Warn("Failed to close the database", log15.Ctx{"error": err})
+	}
+
+	s.logger.Info("Shutdown complete")
 }
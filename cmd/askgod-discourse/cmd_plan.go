@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+	"github.com/urfave/cli/v2"
+)
+
+// discoursePlan is a discourseWriter which prints the changes instead of
+// applying them. Objects it pretends to create get negative IDs.
+type discoursePlan struct {
+	nextID     int64
+	groups     map[int64]string
+	categories map[int64]string
+	topics     map[int64]string
+}
+
+func (p *discoursePlan) newID() int64 {
+	p.nextID--
+	return p.nextID
+}
+
+func (p *discoursePlan) print(team string, action string, body string) {
+	if team != "" {
+		fmt.Printf("[%s] %s\n", team, action)
+	} else {
+		fmt.Printf("%s\n", action)
+	}
+
+	if body == "" {
+		return
+	}
+
+	for _, line := range strings.Split(body, "\n") {
+		fmt.Printf("    | %s\n", line)
+	}
+}
+
+func (p *discoursePlan) createGroup(ctx context.Context, name string, fullName string) (int64, error) {
+	id := p.newID()
+	p.groups[id] = name
+
+	p.print(name, fmt.Sprintf("Create group %q (%s)", name, fullName), "")
+	return id, nil
+}
+
+func (p *discoursePlan) updateGroup(ctx context.Context, id int64, name string, fullName string) error {
+	p.print(name, fmt.Sprintf("Rename group %d from %q to %q (%s)", id, p.groups[id], name, fullName), "")
+	p.groups[id] = name
+	return nil
+}
+
+func (p *discoursePlan) deleteGroup(ctx context.Context, id int64) error {
+	p.print("", fmt.Sprintf("Delete group %d", id), "")
+	return nil
+}
+
+func (p *discoursePlan) createCategory(ctx context.Context, category discourseCategoryPost) (int64, error) {
+	id := p.newID()
+	p.categories[id] = category.Slug
+
+	p.print(category.Slug, fmt.Sprintf("Create category %q%s", category.Name, planPermissions(category)), "")
+	return id, nil
+}
+
+func (p *discoursePlan) updateCategory(ctx context.Context, id int64, category discourseCategoryPost) error {
+	p.print(p.categories[id], fmt.Sprintf("Update category %d to %q under %q%s", id, category.Name, category.ParentCategory, planPermissions(category)), "")
+	return nil
+}
+
+// planPermissions describes the permissions of a category, if they're changed.
+func planPermissions(category discourseCategoryPost) string {
+	if len(category.Permissions) == 0 {
+		return ""
+	}
+
+	permissions := []string{}
+	for group, permission := range category.Permissions {
+		permissions = append(permissions, fmt.Sprintf("%s=%s", group, permission))
+	}
+	sort.Strings(permissions)
+
+	return fmt.Sprintf(" with %s", strings.Join(permissions, ", "))
+}
+
+func (p *discoursePlan) deleteCategory(ctx context.Context, id int64, name string) error {
+	p.print(name, fmt.Sprintf("Delete category %d and all its topics", id), "")
+	return nil
+}
+
+func (p *discoursePlan) createTopic(ctx context.Context, category int64, title string, body string, apiUser string, apiKey string) (int64, error) {
+	id := p.newID()
+
+	team, ok := p.categories[category]
+	if !ok {
+		team = fmt.Sprintf("category %d", category)
+	}
+	p.topics[id] = team
+
+	p.print(team, fmt.Sprintf("Create topic %q as %s", title, apiUser), stripIntentMarker(body))
+	return id, nil
+}
+
+func (p *discoursePlan) updateTopic(ctx context.Context, id int64, title string, body string, apiUser string, apiKey string) error {
+	p.print(p.topics[id], fmt.Sprintf("Update topic %d to %q", id, title), body)
+	return nil
+}
+
+func (p *discoursePlan) deleteTopic(ctx context.Context, id int64) error {
+	p.print(p.topics[id], fmt.Sprintf("Delete topic %d", id), "")
+	return nil
+}
+
+func (p *discoursePlan) createPost(ctx context.Context, topic int64, body string, apiUser string, apiKey string) (int64, error) {
+	id := p.newID()
+	p.topics[id] = p.topics[topic]
+
+	p.print(p.topics[topic], fmt.Sprintf("Create post in topic %d as %s", topic, apiUser), stripIntentMarker(body))
+	return id, nil
+}
+
+func (p *discoursePlan) updatePost(ctx context.Context, id int64, body string, apiUser string, apiKey string) error {
+	p.print(p.topics[id], fmt.Sprintf("Update post %d", id), body)
+	return nil
+}
+
+func (p *discoursePlan) deletePost(ctx context.Context, id int64) error {
+	p.print(p.topics[id], fmt.Sprintf("Delete post %d", id), "")
+	return nil
+}
+
+func cmdPlan(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		cli.ShowCommandHelp(ctx, "plan")
+		return fmt.Errorf("Missing required arguments")
+	}
+
+	// Load configuration
+	s, err := getSyncer(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+
+	// Keep the output for the plan itself
+	s.logger.SetHandler(log15.LvlFilterHandler(log15.LvlWarn, log15.StderrHandler))
+
+	// Work on a copy of the database
+	tmpDB, err := ioutil.TempFile("", "askgod-discourse-plan-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpDB.Name())
+
+	srcDB, err := os.Open(s.config.Database)
+	if err == nil {
+		_, err = io.Copy(tmpDB, srcDB)
+		srcDB.Close()
+		if err != nil {
+			tmpDB.Close()
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		tmpDB.Close()
+		return err
+	}
+
+	err = tmpDB.Close()
+	if err != nil {
+		return err
+	}
+
+	s.config.Database = tmpDB.Name()
+
+	// Connect to the DB
+	err = s.dbSetup()
+	if err != nil {
+		return err
+	}
+	defer s.db.Close()
+
+	// Record what's currently published
+	plan := &discoursePlan{
+		groups:     map[int64]string{},
+		categories: map[int64]string{},
+		topics:     map[int64]string{},
+	}
+
+	dbTeams, err := s.dbGetTeams()
+	if err != nil {
+		return err
+	}
+
+	dbTeamPosts, err := s.dbGetTeamPosts()
+	if err != nil {
+		return err
+	}
+
+	for _, team := range dbTeams {
+		plan.groups[team.DiscourseGroupID] = team.DiscourseName
+		plan.categories[team.DiscourseCategoryID] = team.DiscourseName
+
+		for _, ids := range dbTeamPosts[team.AskgodID] {
+			for _, id := range ids {
+				plan.topics[id] = team.DiscourseName
+			}
+		}
+	}
+
+	s.discourse = plan
+
+	// Run the syncs
+	err = s.syncTeams(context.Background())
+	if err != nil {
+		return err
+	}
+
+	err = s.syncPosts(context.Background())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
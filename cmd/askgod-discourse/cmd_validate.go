@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+	"github.com/urfave/cli/v2"
+)
+
+func cmdValidate(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		cli.ShowCommandHelp(ctx, "validate")
+		return fmt.Errorf("Missing required arguments")
+	}
+
+	// Load configuration
+	s, err := getSyncer(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+
+	// Keep the output for the problems found
+	s.logger.SetHandler(log15.LvlFilterHandler(log15.LvlWarn, log15.StderrHandler))
+
+	// Get the teams which are synced to discourse
+	askgodTeams, err := s.askgodGetTeams(context.Background())
+	if err != nil {
+		return err
+	}
+
+	teamIDs := []int64{}
+	for _, team := range askgodTeams {
+		if team.Tags["discourse"] == "" {
+			continue
+		}
+
+		teamIDs = append(teamIDs, team.ID)
+	}
+
+	// Get the flag tags
+	askgodFlags, err := s.askgodGetTeamDiscourseFlags(context.Background())
+	if err != nil {
+		return err
+	}
+
+	// Enumerate the posts directory
+	files, err := ioutil.ReadDir(s.config.Posts)
+	if err != nil {
+		return err
+	}
+
+	// Parse all the files, keeping track of all failures
+	problems := []string{}
+	posts := map[string]post{}
+	paths := map[string]string{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".yaml") {
+			continue
+		}
+
+		path := filepath.Join(s.config.Posts, file.Name())
+		newPost, err := parsePost(path, true)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+
+		name := strings.TrimSuffix(file.Name(), ".yaml")
+		posts[name] = *newPost
+		paths[name] = path
+	}
+
+	// Validate the posts in a stable order
+	names := []string{}
+	for name := range posts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		entry := posts[name]
+		for _, err := range entry.validate(posts, teamIDs, askgodFlags) {
+			problems = append(problems, fmt.Sprintf("%s: %v", paths[name], err))
+		}
+	}
+
+	// Report
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Found %d problems in %s", len(problems), s.config.Posts)
+	}
+
+	fmt.Printf("All %d posts are valid\n", len(posts))
+	return nil
+}
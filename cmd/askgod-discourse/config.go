@@ -3,28 +3,84 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"text/template"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 type config struct {
-	AskgodURL  string `yaml:"askgod_url"`
-	AskgodCert string `yaml:"askgod_cert"`
+	AskgodURL              string        `yaml:"askgod_url"`
+	AskgodCert             string        `yaml:"askgod_cert"`
+	AskgodReconnectTimeout time.Duration `yaml:"askgod_reconnect_timeout"`
+	AskgodRetry            retryConfig   `yaml:"askgod_retry"`
 
 	Database string `yaml:"database"`
 	Posts    string `yaml:"posts"`
 
-	DiscourseURL     string `yaml:"discourse_url"`
-	DiscourseCert    string `yaml:"discourse_cert"`
-	DiscourseAPIKey  string `yaml:"discourse_api_key"`
-	DiscourseAPIUser string `yaml:"discourse_api_user"`
+	DiscourseURL     string      `yaml:"discourse_url"`
+	DiscourseCert    string      `yaml:"discourse_cert"`
+	DiscourseAPIKey  string      `yaml:"discourse_api_key"`
+	DiscourseAPIUser string      `yaml:"discourse_api_user"`
+	DiscourseRetry   retryConfig `yaml:"discourse_retry"`
 
 	CategoryAccess    []string `yaml:"category_access"`
 	CategoryColor     string   `yaml:"category_color"`
 	CategoryTextColor string   `yaml:"category_text_color"`
 	CategoryParent    string   `yaml:"category_parent"`
 
+	CategoryName        string `yaml:"category_name"`
+	CategoryDescription string `yaml:"category_description"`
+
+	TeamRemoval           string `yaml:"team_removal"`
+	TeamRemovalLimit      int    `yaml:"team_removal_limit"`
+	ArchiveCategoryParent string `yaml:"archive_category_parent"`
+
 	PublishRestricted []string `yaml:"publish_restricted"`
+
+	Membership            []string `yaml:"membership"`
+	MembershipInviteField string   `yaml:"membership_invite_field"`
+
+	MembershipReconcile         string        `yaml:"membership_reconcile"`
+	MembershipReconcileInterval time.Duration `yaml:"membership_reconcile_interval"`
+
+	MaxMembersPerTeam int64 `yaml:"max_members_per_team"`
+
+	UnmatchedUsers        string `yaml:"unmatched_users"`
+	UnmatchedRejectReason string `yaml:"unmatched_reject_reason"`
+	UnmatchedCategory     string `yaml:"unmatched_category"`
+
+	ListenAddress      string `yaml:"listen_address"`
+	WebhookSecret      string `yaml:"webhook_secret"`
+	AdminListenAddress string `yaml:"admin_listen_address"`
+	AdminToken         string `yaml:"admin_token"`
+
+	HealthTimerThreshold time.Duration `yaml:"health_timer_threshold"`
+
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	categoryName        *template.Template
+	categoryDescription *template.Template
+}
+
+type retryConfig struct {
+	Attempts   int           `yaml:"attempts"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+func (r *retryConfig) setDefaults() {
+	if r.Attempts <= 0 {
+		r.Attempts = 5
+	}
+
+	if r.Backoff <= 0 {
+		r.Backoff = time.Second
+	}
+
+	if r.MaxBackoff <= 0 {
+		r.MaxBackoff = 30 * time.Second
+	}
 }
 
 func parseConfig(path string) (*config, error) {
@@ -41,5 +97,103 @@ func parseConfig(path string) (*config, error) {
 		return nil, fmt.Errorf("Failed to parse yaml: %v", err)
 	}
 
+	// Apply the defaults
+	config.AskgodRetry.setDefaults()
+	config.DiscourseRetry.setDefaults()
+
+	if config.TeamRemoval == "" {
+		config.TeamRemoval = "delete"
+	}
+
+	if config.TeamRemovalLimit == 0 {
+		config.TeamRemovalLimit = 5
+	}
+
+	if len(config.Membership) == 0 {
+		config.Membership = []string{"subnet"}
+	}
+
+	if config.MembershipReconcile == "" {
+		config.MembershipReconcile = "disabled"
+	}
+
+	if config.MembershipReconcileInterval == 0 {
+		config.MembershipReconcileInterval = 10 * time.Minute
+	}
+
+	if config.UnmatchedUsers == "" {
+		config.UnmatchedUsers = "pending"
+	}
+
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = 30 * time.Second
+	}
+
+	if config.HealthTimerThreshold == 0 {
+		config.HealthTimerThreshold = 5 * time.Minute
+	}
+
+	if config.CategoryName == "" {
+		config.CategoryName = "{{.Slug}}"
+	}
+
+	// Parse the templates
+	config.categoryName, err = template.New("category_name").Parse(config.CategoryName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse category_name: %v", err)
+	}
+
+	config.categoryDescription, err = template.New("category_description").Parse(config.CategoryDescription)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse category_description: %v", err)
+	}
+
+	// Validate the values
+	if !stringInSlice(config.TeamRemoval, []string{"delete", "archive", "ignore"}) {
+		return nil, fmt.Errorf("Invalid team_removal policy: %s", config.TeamRemoval)
+	}
+
+	if config.TeamRemoval == "archive" && config.ArchiveCategoryParent == "" {
+		return nil, fmt.Errorf("The archive policy requires archive_category_parent to be set")
+	}
+
+	if !stringInSlice(config.MembershipReconcile, []string{"disabled", "report", "fix"}) {
+		return nil, fmt.Errorf("Invalid membership_reconcile mode: %s", config.MembershipReconcile)
+	}
+
+	if config.WebhookSecret != "" && config.ListenAddress == "" {
+		return nil, fmt.Errorf("The webhook receiver requires listen_address to be set")
+	}
+
+	if config.AdminToken != "" && config.AdminListenAddress == "" {
+		return nil, fmt.Errorf("The admin API requires admin_listen_address to be set")
+	}
+
+	if config.AdminListenAddress != "" && config.AdminListenAddress == config.ListenAddress {
+		return nil, fmt.Errorf("The admin API can't share listen_address with the public endpoints")
+	}
+
+	if config.MaxMembersPerTeam < 0 {
+		return nil, fmt.Errorf("Invalid max_members_per_team: %d", config.MaxMembersPerTeam)
+	}
+
+	if !stringInSlice(config.UnmatchedUsers, []string{"pending", "reject", "notify"}) {
+		return nil, fmt.Errorf("Invalid unmatched_users policy: %s", config.UnmatchedUsers)
+	}
+
+	if config.UnmatchedUsers == "notify" && config.UnmatchedCategory == "" {
+		return nil, fmt.Errorf("The notify policy requires unmatched_category to be set")
+	}
+
+	for _, strategy := range config.Membership {
+		if !stringInSlice(strategy, []string{"subnet", "invite", "email", "username"}) {
+			return nil, fmt.Errorf("Invalid membership strategy: %s", strategy)
+		}
+
+		if strategy == "invite" && config.MembershipInviteField == "" {
+			return nil, fmt.Errorf("The invite membership strategy requires membership_invite_field")
+		}
+	}
+
 	return &config, nil
 }
@@ -2,17 +2,23 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/inconshreveable/log15"
 )
 
 func (s *syncer) getClient(server string, serverCert string) (*http.Client, error) {
@@ -71,7 +77,7 @@ func (s *syncer) getClient(server string, serverCert string) (*http.Client, erro
 	return &client, nil
 }
 
-func (s *syncer) websocket(server string, path string) (*websocket.Conn, error) {
+func (s *syncer) websocket(ctx context.Context, server string, path string) (*websocket.Conn, error) {
 	// Server-specific configuration
 	var srv *http.Client
 	var url string
@@ -98,7 +104,7 @@ func (s *syncer) websocket(server string, path string) (*websocket.Conn, error)
 	}
 
 	// Establish the connection
-	conn, _, err := dialer.Dial(url, nil)
+	conn, _, err := dialer.DialContext(ctx, url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -106,103 +112,170 @@ func (s *syncer) websocket(server string, path string) (*websocket.Conn, error)
 	return conn, err
 }
 
+// queryError is returned when the server answered with an error status.
+type queryError struct {
+	status  int
+	message string
+}
+
+func (e queryError) Error() string {
+	return e.message
+}
+
+// isNotFound returns whether the server reported the target as missing.
+func isNotFound(err error) bool {
+	var qErr queryError
+	if errors.As(err, &qErr) {
+		return qErr.status == http.StatusNotFound
+	}
+
+	return false
+}
+
 type queryArgs struct {
 	discourseUser string
 	discourseKey  string
 }
 
-func (s *syncer) queryStruct(server string, method string, path string, data interface{}, target interface{}, args *queryArgs) error {
-	var req *http.Request
-	var err error
-
+func (s *syncer) queryStruct(ctx context.Context, server string, method string, path string, data interface{}, target interface{}, args *queryArgs) error {
 	// Server-specific configuration
 	var srv *http.Client
 	var url string
+	var retry retryConfig
 	if server == "askgod" {
 		srv = s.httpAskgod
 		url = fmt.Sprintf("%s/1.0%s", s.config.AskgodURL, path)
+		retry = s.config.AskgodRetry
 	} else if server == "discourse" {
 		srv = s.httpDiscourse
 		url = fmt.Sprintf("%s%s", s.config.DiscourseURL, path)
+		retry = s.config.DiscourseRetry
 	} else {
 		return fmt.Errorf("Unknown server: %s", server)
 	}
 
-	// Get a new HTTP request setup
+	// Encode the provided data
+	var body []byte
 	if data != nil {
-		// Encode the provided data
 		buf := bytes.Buffer{}
 		err := json.NewEncoder(&buf).Encode(data)
 		if err != nil {
 			return err
 		}
 
-		// Some data to be sent along with the request
-		req, err = http.NewRequest(method, url, &buf)
-		if err != nil {
-			return err
-		}
+		body = buf.Bytes()
+	}
 
-		// Set the encoding accordingly
-		req.Header.Set("Content-Type", "application/json")
+	backoff := retry.Backoff
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		resp, err := s.queryRequest(ctx, srv, server, method, url, body, args)
+
+		status := "error"
+		if err == nil {
+			status = strconv.Itoa(resp.StatusCode)
+		}
 
-		// Handle authentication
-		if server == "discourse" {
-			if args != nil && args.discourseUser != "" {
-				req.Header.Set("Api-Username", args.discourseUser)
-			} else {
-				req.Header.Set("Api-Username", s.config.DiscourseAPIUser)
+		metricRequests.WithLabelValues(server, method, status).Inc()
+		metricRequestDuration.WithLabelValues(server, method).Observe(time.Since(start).Seconds())
+
+		// Figure out if the request should be retried, only GET is safe to
+		// repeat once the server may have acted on the request
+		wait := backoff
+		if err == nil {
+			retryable := resp.StatusCode == http.StatusTooManyRequests || (method == "GET" && resp.StatusCode >= http.StatusInternalServerError)
+			if !retryable || attempt >= retry.Attempts {
+				defer resp.Body.Close()
+				return s.queryResponse(resp, url, target)
 			}
 
-			if args != nil && args.discourseKey != "" {
-				req.Header.Set("Api-Key", args.discourseKey)
-			} else {
-				req.Header.Set("Api-Key", s.config.DiscourseAPIKey)
+			if resp.StatusCode == http.StatusTooManyRequests {
+				retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+				if retryAfter > 0 {
+					wait = retryAfter
+				}
+
+				// Don't let the server hold us (and our locks) for too long
+				if wait > retry.MaxBackoff {
+					wait = retry.MaxBackoff
+				}
 			}
+
+			err = fmt.Errorf("%s", resp.Status)
+			resp.Body.Close()
+		} else if attempt >= retry.Attempts || (method != "GET" && !requestNotSent(err)) {
+			return err
 		}
+
+		s.logger.Warn("Retrying failed request", log15.Ctx{"server": server, "method": method, "path": path, "error": err, "attempt": attempt, "wait": wait})
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+
+		// Exponential backoff
+		backoff *= 2
+		if backoff > retry.MaxBackoff {
+			backoff = retry.MaxBackoff
+		}
+	}
+}
+
+func (s *syncer) queryRequest(ctx context.Context, srv *http.Client, server string, method string, url string, body []byte, args *queryArgs) (*http.Response, error) {
+	// Get a new HTTP request setup
+	var req *http.Request
+	var err error
+	if body != nil {
+		// Some data to be sent along with the request
+		req, err = http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		// Set the encoding accordingly
+		req.Header.Set("Content-Type", "application/json")
 	} else {
 		// No data to be sent along with the request
-		req, err = http.NewRequest(method, url, nil)
+		req, err = http.NewRequestWithContext(ctx, method, url, nil)
 		if err != nil {
-			return err
+			return nil, err
 		}
+	}
 
-		// Handle authentication
-		if server == "discourse" {
-			if args != nil && args.discourseUser != "" {
-				req.Header.Set("Api-Username", args.discourseUser)
-			} else {
-				req.Header.Set("Api-Username", s.config.DiscourseAPIUser)
-			}
+	// Handle authentication
+	if server == "discourse" {
+		if args != nil && args.discourseUser != "" {
+			req.Header.Set("Api-Username", args.discourseUser)
+		} else {
+			req.Header.Set("Api-Username", s.config.DiscourseAPIUser)
+		}
 
-			if args != nil && args.discourseKey != "" {
-				req.Header.Set("Api-Key", args.discourseKey)
-			} else {
-				req.Header.Set("Api-Key", s.config.DiscourseAPIKey)
-			}
+		if args != nil && args.discourseKey != "" {
+			req.Header.Set("Api-Key", args.discourseKey)
+		} else {
+			req.Header.Set("Api-Key", s.config.DiscourseAPIKey)
 		}
 	}
 
 	// Send the request
-	resp, err := srv.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+	return srv.Do(req)
+}
 
+func (s *syncer) queryResponse(resp *http.Response, url string, target interface{}) error {
 	if resp.StatusCode != http.StatusOK {
 		content, err := ioutil.ReadAll(resp.Body)
 		if err == nil && string(content) != "" {
-			return fmt.Errorf("%s", strings.TrimSpace(string(content)))
+			return queryError{status: resp.StatusCode, message: strings.TrimSpace(string(content))}
 		}
 
-		return fmt.Errorf("%s: %s", url, resp.Status)
+		return queryError{status: resp.StatusCode, message: fmt.Sprintf("%s: %s", url, resp.Status)}
 	}
 
 	// Decode the response
 	if target != nil {
 		decoder := json.NewDecoder(resp.Body)
-		err = decoder.Decode(&target)
+		err := decoder.Decode(&target)
 		if err != nil {
 			return err
 		}
@@ -210,3 +283,32 @@ func (s *syncer) queryStruct(server string, method string, path string, data int
 
 	return nil
 }
+
+// requestNotSent returns whether the request failed before reaching the server.
+func requestNotSent(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Op == "dial"
+	}
+
+	return false
+}
+
+// parseRetryAfter handles both the delay in seconds and the HTTP date forms.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	ts, err := http.ParseTime(value)
+	if err == nil {
+		return time.Until(ts)
+	}
+
+	return 0
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"empty", "", 0, 0},
+		{"seconds", "30", 30 * time.Second, 30 * time.Second},
+		{"invalid", "soon", 0, 0},
+		{"date", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+	}
+
+	for _, test := range tests {
+		wait := parseRetryAfter(test.value)
+		if wait < test.min || wait > test.max {
+			t.Errorf("%s: expected a wait between %v and %v, got %v", test.name, test.min, test.max, wait)
+		}
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
+	"time"
 
+	"github.com/inconshreveable/log15"
 	"github.com/mattn/go-sqlite3"
 )
 
@@ -13,7 +16,11 @@ CREATE TABLE IF NOT EXISTS teams (
     askgod_name TEXT,
     discourse_name TEXT,
     discourse_group_id INTEGER NOT NULL,
-    discourse_category_id INTEGER NOT NULL
+    discourse_category_id INTEGER NOT NULL,
+    archived INTEGER NOT NULL DEFAULT 0,
+    discourse_color TEXT NOT NULL DEFAULT '',
+    discourse_text_color TEXT NOT NULL DEFAULT '',
+    discourse_parent TEXT NOT NULL DEFAULT ''
 );
 
 CREATE TABLE IF NOT EXISTS posts (
@@ -21,10 +28,72 @@ CREATE TABLE IF NOT EXISTS posts (
     name TEXT,
     team_id INTEGER NOT NULL,
     discourse_post_id INTEGER NOT NULL,
+    created_at INTEGER NOT NULL DEFAULT 0,
+    content_hash TEXT NOT NULL DEFAULT '',
     FOREIGN KEY(team_id) REFERENCES teams (id) ON DELETE CASCADE
 );
+
+CREATE TABLE IF NOT EXISTS intents (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    name TEXT NOT NULL,
+    team_id INTEGER NOT NULL,
+    type TEXT NOT NULL,
+    discourse_target_id INTEGER NOT NULL,
+    title TEXT NOT NULL DEFAULT '',
+    content_hash TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY(team_id) REFERENCES teams (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS ranks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    team_id INTEGER NOT NULL,
+    rank INTEGER NOT NULL,
+    recorded_at INTEGER NOT NULL,
+    FOREIGN KEY(team_id) REFERENCES teams (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS retractions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    name TEXT NOT NULL,
+    team_id INTEGER NOT NULL,
+    UNIQUE(name, team_id),
+    FOREIGN KEY(team_id) REFERENCES teams (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS overrides (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    name TEXT NOT NULL,
+    team_id INTEGER NOT NULL,
+    UNIQUE(name, team_id),
+    FOREIGN KEY(team_id) REFERENCES teams (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS unmatched_users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    discourse_user_id INTEGER NOT NULL UNIQUE,
+    username TEXT NOT NULL,
+    reported_at INTEGER NOT NULL,
+    reason TEXT NOT NULL DEFAULT ''
+);
 `
 
+// Columns added after the initial schema, applied to existing databases
+var schemaUpdates = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"posts", "created_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"posts", "content_hash", "TEXT NOT NULL DEFAULT ''"},
+	{"teams", "archived", "INTEGER NOT NULL DEFAULT 0"},
+	{"teams", "discourse_color", "TEXT NOT NULL DEFAULT ''"},
+	{"teams", "discourse_text_color", "TEXT NOT NULL DEFAULT ''"},
+	{"teams", "discourse_parent", "TEXT NOT NULL DEFAULT ''"},
+	{"unmatched_users", "reason", "TEXT NOT NULL DEFAULT ''"},
+	{"intents", "created_at", "INTEGER NOT NULL DEFAULT 0"},
+}
+
 type dbTeam struct {
 	ID                  int64
 	AskgodID            int64
@@ -32,6 +101,31 @@ type dbTeam struct {
 	DiscourseName       string
 	DiscourseGroupID    int64
 	DiscourseCategoryID int64
+	Archived            bool
+	Color               string
+	TextColor           string
+	Parent              string
+}
+
+// appearance returns the category appearance last applied to the team.
+func (t dbTeam) appearance() teamAppearance {
+	return teamAppearance{Color: t.Color, TextColor: t.TextColor, Parent: t.Parent}
+}
+
+// provisioned returns whether the team's discourse setup was completed.
+func (t dbTeam) provisioned() bool {
+	return t.DiscourseGroupID != 0 && t.DiscourseCategoryID != 0
+}
+
+type dbIntent struct {
+	ID                int64
+	Name              string
+	AskgodID          int64
+	Type              string
+	DiscourseTargetID int64
+	Title             string
+	ContentHash       string
+	CreatedAt         time.Time
 }
 
 func enableForeignKeys(conn *sqlite3.SQLiteConn) error {
@@ -70,18 +164,49 @@ func (s *syncer) dbSetup() error {
 		return err
 	}
 
+	// Update the DB schema (if needed)
+	err = s.dbUpdateSchema()
+	if err != nil {
+		return err
+	}
+
 	// Set the connection limit for the DB pool
 	s.db.SetMaxOpenConns(10)
 
 	return nil
 }
 
+func (s *syncer) dbUpdateSchema() error {
+	for _, update := range schemaUpdates {
+		// Check if the column already exists
+		count := 0
+		err := s.db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?;", update.table, update.column).Scan(&count)
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			continue
+		}
+
+		// Add the missing column
+		_, err = s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", update.table, update.column, update.definition))
+		if err != nil {
+			return err
+		}
+
+		s.logger.Info("Updated database schema", log15.Ctx{"table": update.table, "column": update.column})
+	}
+
+	return nil
+}
+
 func (s *syncer) dbGetTeams() ([]dbTeam, error) {
 	// Return a list of teams
 	resp := []dbTeam{}
 
 	// Query all the teams from the database
-	rows, err := s.db.Query("SELECT id, askgod_id, askgod_name, discourse_name, discourse_group_id, discourse_category_id FROM teams ORDER BY id ASC;")
+	rows, err := s.db.Query("SELECT id, askgod_id, askgod_name, discourse_name, discourse_group_id, discourse_category_id, archived, discourse_color, discourse_text_color, discourse_parent FROM teams ORDER BY id ASC;")
 	if err != nil {
 		return nil, err
 	}
@@ -91,7 +216,7 @@ func (s *syncer) dbGetTeams() ([]dbTeam, error) {
 	for rows.Next() {
 		row := dbTeam{}
 
-		err := rows.Scan(&row.ID, &row.AskgodID, &row.AskgodName, &row.DiscourseName, &row.DiscourseGroupID, &row.DiscourseCategoryID)
+		err := rows.Scan(&row.ID, &row.AskgodID, &row.AskgodName, &row.DiscourseName, &row.DiscourseGroupID, &row.DiscourseCategoryID, &row.Archived, &row.Color, &row.TextColor, &row.Parent)
 		if err != nil {
 			return nil, err
 		}
@@ -108,10 +233,40 @@ func (s *syncer) dbGetTeams() ([]dbTeam, error) {
 	return resp, nil
 }
 
-func (s *syncer) dbCreateTeam(askgodID int64, askgodName string, discourseName string, discourseGroupID int64, discourseCategoryID int64) error {
+func (s *syncer) dbCreateTeam(askgodID int64, askgodName string, discourseName string, discourseGroupID int64, discourseCategoryID int64, appearance teamAppearance) error {
 	// Create a team DB entry
-	_, err := s.db.Exec("INSERT INTO teams (askgod_id, askgod_name, discourse_name, discourse_group_id, discourse_category_id) VALUES (?, ?, ?, ?, ?);",
-		askgodID, askgodName, discourseName, discourseGroupID, discourseCategoryID)
+	_, err := s.db.Exec("INSERT INTO teams (askgod_id, askgod_name, discourse_name, discourse_group_id, discourse_category_id, discourse_color, discourse_text_color, discourse_parent) VALUES (?, ?, ?, ?, ?, ?, ?, ?);",
+		askgodID, askgodName, discourseName, discourseGroupID, discourseCategoryID, appearance.Color, appearance.TextColor, appearance.Parent)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *syncer) dbUpdateTeamDiscourse(askgodID int64, discourseGroupID int64, discourseCategoryID int64) error {
+	// Record the discourse objects of the team
+	_, err := s.db.Exec("UPDATE teams SET discourse_group_id=?, discourse_category_id=? WHERE askgod_id=?;", discourseGroupID, discourseCategoryID, askgodID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *syncer) dbArchiveTeam(askgodID int64, archived bool) error {
+	// Change the archival state
+	_, err := s.db.Exec("UPDATE teams SET archived=? WHERE askgod_id=?;", archived, askgodID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *syncer) dbRetagTeam(askgodID int64, discourseName string) error {
+	// Change the discourse name on record
+	_, err := s.db.Exec("UPDATE teams SET discourse_name=? WHERE askgod_id=?;", discourseName, askgodID)
 	if err != nil {
 		return err
 	}
@@ -119,9 +274,19 @@ func (s *syncer) dbCreateTeam(askgodID int64, askgodName string, discourseName s
 	return nil
 }
 
-func (s *syncer) dbRenameTeam(discourseGroupID int64, askgodName string) error {
+func (s *syncer) dbUpdateTeamAppearance(askgodID int64, appearance teamAppearance) error {
+	// Change the category appearance on record
+	_, err := s.db.Exec("UPDATE teams SET discourse_color=?, discourse_text_color=?, discourse_parent=? WHERE askgod_id=?;", appearance.Color, appearance.TextColor, appearance.Parent, askgodID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *syncer) dbRenameTeam(askgodID int64, askgodName string) error {
 	// Change the askgod name on record
-	_, err := s.db.Exec("UPDATE teams SET askgod_name=? WHERE discourse_group_id=?;", askgodName, discourseGroupID)
+	_, err := s.db.Exec("UPDATE teams SET askgod_name=? WHERE askgod_id=?;", askgodName, askgodID)
 	if err != nil {
 		return err
 	}
@@ -149,12 +314,22 @@ func (s *syncer) dbDeletePost(discoursePostID int64) error {
 	return nil
 }
 
+func (s *syncer) dbDeleteTeamPost(askgodID int64, postName string) error {
+	// Delete all the DB entries of a post for a team
+	_, err := s.db.Exec("DELETE FROM posts WHERE team_id=(SELECT id FROM teams WHERE askgod_id=?) AND name=?;", askgodID, postName)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (s *syncer) dbGetTeamPosts() (map[int64]map[string][]int64, error) {
 	// Return a map of askgod teamids to map of post to postid
 	resp := map[int64]map[string][]int64{}
 
 	// Fetch the needed data
-	rows, err := s.db.Query("SELECT teams.askgod_id, posts.name, posts.discourse_post_id FROM posts LEFT JOIN teams ON teams.id=posts.team_id;")
+	rows, err := s.db.Query("SELECT teams.askgod_id, posts.name, posts.discourse_post_id FROM posts LEFT JOIN teams ON teams.id=posts.team_id ORDER BY posts.id ASC;")
 	if err != nil {
 		return nil, err
 	}
@@ -189,9 +364,368 @@ func (s *syncer) dbGetTeamPosts() (map[int64]map[string][]int64, error) {
 	return resp, nil
 }
 
-func (s *syncer) dbCreatePost(askgodID int64, postName string, postID int64) error {
-	_, err := s.db.Exec("INSERT INTO posts (team_id, name, discourse_post_id) VALUES ((SELECT id FROM teams WHERE askgod_id=?), ?, ?);",
-		askgodID, postName, postID)
+func (s *syncer) dbGetTeamPostTimes() (map[int64]map[string]time.Time, error) {
+	// Return a map of askgod teamids to map of post to publication time
+	resp := map[int64]map[string]time.Time{}
+
+	// Fetch the needed data
+	rows, err := s.db.Query("SELECT teams.askgod_id, posts.name, MIN(posts.created_at) FROM posts LEFT JOIN teams ON teams.id=posts.team_id GROUP BY teams.askgod_id, posts.name;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Iterate through the results
+	for rows.Next() {
+		teamid := int64(-1)
+		name := ""
+		created := int64(0)
+
+		err := rows.Scan(&teamid, &name, &created)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp[teamid] == nil {
+			resp[teamid] = map[string]time.Time{}
+		}
+
+		// Posts predating the column are considered as published long ago
+		resp[teamid][name] = time.Unix(created, 0)
+	}
+
+	// Check for any error that might have happened
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (s *syncer) dbGetTeamPostHashes() (map[int64]map[string]map[int64]string, error) {
+	// Return a map of askgod teamids to map of post to postid to content hash
+	resp := map[int64]map[string]map[int64]string{}
+
+	// Fetch the needed data
+	rows, err := s.db.Query("SELECT teams.askgod_id, posts.name, posts.discourse_post_id, posts.content_hash FROM posts LEFT JOIN teams ON teams.id=posts.team_id;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Iterate through the results
+	for rows.Next() {
+		teamid := int64(-1)
+		name := ""
+		postid := int64(-1)
+		hash := ""
+
+		err := rows.Scan(&teamid, &name, &postid, &hash)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp[teamid] == nil {
+			resp[teamid] = map[string]map[int64]string{}
+		}
+		if resp[teamid][name] == nil {
+			resp[teamid][name] = map[int64]string{}
+		}
+		resp[teamid][name][postid] = hash
+	}
+
+	// Check for any error that might have happened
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (s *syncer) dbUpdatePostHash(postName string, postID int64, hash string) error {
+	// Record the new content hash
+	_, err := s.db.Exec("UPDATE posts SET content_hash=? WHERE name=? AND discourse_post_id=?;", hash, postName, postID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *syncer) dbCreateIntent(askgodID int64, postName string, postType string, targetID int64, title string, hash string) (int64, error) {
+	// Record the intent to publish
+	result, err := s.db.Exec("INSERT INTO intents (team_id, name, type, discourse_target_id, title, content_hash, created_at) VALUES ((SELECT id FROM teams WHERE askgod_id=?), ?, ?, ?, ?, ?, ?);",
+		askgodID, postName, postType, targetID, title, hash, time.Now().Unix())
+	if err != nil {
+		return -1, err
+	}
+
+	return result.LastInsertId()
+}
+
+func (s *syncer) dbCompleteIntent(intentID int64, askgodID int64, postName string, postID int64, hash string) error {
+	// Record the post and clear the intent at once
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO posts (team_id, name, discourse_post_id, created_at, content_hash) VALUES ((SELECT id FROM teams WHERE askgod_id=?), ?, ?, ?, ?);",
+		askgodID, postName, postID, time.Now().Unix(), hash)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM intents WHERE id=?;", intentID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *syncer) dbDeleteIntent(intentID int64) error {
+	_, err := s.db.Exec("DELETE FROM intents WHERE id=?;", intentID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *syncer) dbGetIntents() ([]dbIntent, error) {
+	// Return a list of intents
+	resp := []dbIntent{}
+
+	// Query all the intents from the database
+	rows, err := s.db.Query("SELECT intents.id, intents.name, teams.askgod_id, intents.type, intents.discourse_target_id, intents.title, intents.content_hash, intents.created_at FROM intents LEFT JOIN teams ON teams.id=intents.team_id ORDER BY intents.id ASC;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Iterate through the results
+	for rows.Next() {
+		row := dbIntent{}
+		created := int64(0)
+
+		err := rows.Scan(&row.ID, &row.Name, &row.AskgodID, &row.Type, &row.DiscourseTargetID, &row.Title, &row.ContentHash, &created)
+		if err != nil {
+			return nil, err
+		}
+
+		// Intents predating the column could be of any age
+		if created > 0 {
+			row.CreatedAt = time.Unix(created, 0)
+		}
+
+		resp = append(resp, row)
+	}
+
+	// Check for any error that might have happened
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (s *syncer) dbGetRankHistory() (map[int64][]rankRecord, error) {
+	// Return a map of askgod teamids to their rank changes, oldest first
+	resp := map[int64][]rankRecord{}
+
+	// Fetch the needed data
+	rows, err := s.db.Query("SELECT teams.askgod_id, ranks.rank, ranks.recorded_at FROM ranks LEFT JOIN teams ON teams.id=ranks.team_id ORDER BY ranks.recorded_at ASC, ranks.id ASC;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Iterate through the results
+	for rows.Next() {
+		teamid := int64(-1)
+		rank := int64(0)
+		recorded := int64(0)
+
+		err := rows.Scan(&teamid, &rank, &recorded)
+		if err != nil {
+			return nil, err
+		}
+
+		resp[teamid] = append(resp[teamid], rankRecord{Rank: rank, Time: time.Unix(recorded, 0)})
+	}
+
+	// Check for any error that might have happened
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (s *syncer) dbCreateRanks(ranks map[int64]int64, recorded time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Teams which aren't on discourse are skipped
+	for teamid, rank := range ranks {
+		_, err = tx.Exec("INSERT INTO ranks (team_id, rank, recorded_at) SELECT id, ?, ? FROM teams WHERE askgod_id=?;", rank, recorded.Unix(), teamid)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *syncer) dbCreateRetraction(askgodID int64, name string) error {
+	// Record the retraction and drop any earlier override at once
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT OR IGNORE INTO retractions (team_id, name) VALUES ((SELECT id FROM teams WHERE askgod_id=?), ?);", askgodID, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM overrides WHERE team_id=(SELECT id FROM teams WHERE askgod_id=?) AND name=?;", askgodID, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *syncer) dbCreateOverride(askgodID int64, name string) error {
+	// Record the override and drop any earlier retraction at once
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT OR IGNORE INTO overrides (team_id, name) VALUES ((SELECT id FROM teams WHERE askgod_id=?), ?);", askgodID, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM retractions WHERE team_id=(SELECT id FROM teams WHERE askgod_id=?) AND name=?;", askgodID, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *syncer) dbGetOverrides() (map[int64]map[string]bool, error) {
+	// Return a map of askgod teamids to the post names published by hand
+	resp := map[int64]map[string]bool{}
+
+	// Fetch the needed data
+	rows, err := s.db.Query("SELECT teams.askgod_id, overrides.name FROM overrides LEFT JOIN teams ON teams.id=overrides.team_id;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Iterate through the results
+	for rows.Next() {
+		teamid := int64(-1)
+		name := ""
+
+		err := rows.Scan(&teamid, &name)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp[teamid] == nil {
+			resp[teamid] = map[string]bool{}
+		}
+		resp[teamid][name] = true
+	}
+
+	// Check for any error that might have happened
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (s *syncer) dbGetRetractions() (map[int64]map[string]bool, error) {
+	// Return a map of askgod teamids to the retracted post names
+	resp := map[int64]map[string]bool{}
+
+	// Fetch the needed data
+	rows, err := s.db.Query("SELECT teams.askgod_id, retractions.name FROM retractions LEFT JOIN teams ON teams.id=retractions.team_id;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Iterate through the results
+	for rows.Next() {
+		teamid := int64(-1)
+		name := ""
+
+		err := rows.Scan(&teamid, &name)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp[teamid] == nil {
+			resp[teamid] = map[string]bool{}
+		}
+		resp[teamid][name] = true
+	}
+
+	// Check for any error that might have happened
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (s *syncer) dbUnmatchedUserReported(userID int64, reason string) (bool, error) {
+	var count int64
+
+	err := s.db.QueryRow("SELECT COUNT(*) FROM unmatched_users WHERE discourse_user_id=? AND reason=?;", userID, reason).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (s *syncer) dbCreateUnmatchedUser(userID int64, username string, reason string) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO unmatched_users (discourse_user_id, username, reported_at, reason) VALUES (?, ?, ?, ?);",
+		userID, username, time.Now().Unix(), reason)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *syncer) dbDeleteUnmatchedUser(userID int64) error {
+	_, err := s.db.Exec("DELETE FROM unmatched_users WHERE discourse_user_id=?;", userID)
 	if err != nil {
 		return err
 	}
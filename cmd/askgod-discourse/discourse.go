@@ -1,35 +1,123 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/inconshreveable/log15"
+	"github.com/nsec/askgod/api"
 )
 
+// discourseWriter performs the Discourse API calls which change state.
+type discourseWriter interface {
+	createGroup(ctx context.Context, name string, fullName string) (int64, error)
+	updateGroup(ctx context.Context, id int64, name string, fullName string) error
+	deleteGroup(ctx context.Context, id int64) error
+
+	createCategory(ctx context.Context, category discourseCategoryPost) (int64, error)
+	updateCategory(ctx context.Context, id int64, category discourseCategoryPost) error
+	deleteCategory(ctx context.Context, id int64, name string) error
+
+	createTopic(ctx context.Context, category int64, title string, body string, apiUser string, apiKey string) (int64, error)
+	updateTopic(ctx context.Context, id int64, title string, body string, apiUser string, apiKey string) error
+	deleteTopic(ctx context.Context, id int64) error
+
+	createPost(ctx context.Context, topic int64, body string, apiUser string, apiKey string) (int64, error)
+	updatePost(ctx context.Context, id int64, body string, apiUser string, apiKey string) error
+	deletePost(ctx context.Context, id int64) error
+}
+
+// discourseAPI is the discourseWriter talking to the Discourse server.
+type discourseAPI struct {
+	s *syncer
+}
+
+func (d *discourseAPI) createGroup(ctx context.Context, name string, fullName string) (int64, error) {
+	return d.s.discourseCreateGroup(ctx, name, fullName)
+}
+
+func (d *discourseAPI) updateGroup(ctx context.Context, id int64, name string, fullName string) error {
+	return d.s.discourseUpdateGroup(ctx, id, name, fullName)
+}
+
+func (d *discourseAPI) deleteGroup(ctx context.Context, id int64) error {
+	return d.s.discourseDeleteGroup(ctx, id)
+}
+
+func (d *discourseAPI) createCategory(ctx context.Context, category discourseCategoryPost) (int64, error) {
+	return d.s.discourseCreateCategory(ctx, category)
+}
+
+func (d *discourseAPI) updateCategory(ctx context.Context, id int64, category discourseCategoryPost) error {
+	return d.s.discourseUpdateCategory(ctx, id, category)
+}
+
+func (d *discourseAPI) deleteCategory(ctx context.Context, id int64, name string) error {
+	return d.s.discourseDeleteCategory(ctx, id, name)
+}
+
+func (d *discourseAPI) createTopic(ctx context.Context, category int64, title string, body string, apiUser string, apiKey string) (int64, error) {
+	return d.s.discourseCreateTopicAs(ctx, category, title, body, apiUser, apiKey)
+}
+
+func (d *discourseAPI) updateTopic(ctx context.Context, id int64, title string, body string, apiUser string, apiKey string) error {
+	return d.s.discourseUpdateTopicAs(ctx, id, title, body, apiUser, apiKey)
+}
+
+func (d *discourseAPI) deleteTopic(ctx context.Context, id int64) error {
+	return d.s.discourseDeleteTopic(ctx, id)
+}
+
+func (d *discourseAPI) createPost(ctx context.Context, topic int64, body string, apiUser string, apiKey string) (int64, error) {
+	return d.s.discourseCreatePostAs(ctx, topic, body, apiUser, apiKey)
+}
+
+func (d *discourseAPI) updatePost(ctx context.Context, id int64, body string, apiUser string, apiKey string) error {
+	return d.s.discourseUpdatePostAs(ctx, id, body, apiUser, apiKey)
+}
+
+func (d *discourseAPI) deletePost(ctx context.Context, id int64) error {
+	return d.s.discourseDeletePost(ctx, id)
+}
+
 // Structs
 type discourseUser struct {
-	ID                    int64  `json:"id"`
-	Username              string `json:"username"`
-	CanApprove            bool   `json:"can_approve"`
-	RegistrationIPAddress string `json:"registration_ip_address"`
+	ID                    int64             `json:"id"`
+	Username              string            `json:"username"`
+	Email                 string            `json:"email"`
+	CanApprove            bool              `json:"can_approve"`
+	Admin                 bool              `json:"admin"`
+	Moderator             bool              `json:"moderator"`
+	RegistrationIPAddress string            `json:"registration_ip_address"`
+	UserFields            map[string]string `json:"user_fields"`
 }
 
 type discourseCategoryPost struct {
 	Name string `json:"name"`
+	Slug string `json:"slug,omitempty"`
+
+	Description string `json:"description,omitempty"`
 
 	Color     string `json:"color"`
 	TextColor string `json:"text_color"`
 
 	ParentCategory string `json:"parent_category_id"`
 
-	Permissions map[string]string `json:"permissions"`
+	Permissions map[string]string `json:"permissions,omitempty"`
 }
 
 type discourseGroup struct {
-	ID   int64  `json:"id"`
-	Name string `json:"name"`
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	FullName  string `json:"full_name"`
+	UserCount int64  `json:"user_count"`
 }
 
 type discourseGroups struct {
@@ -44,10 +132,10 @@ type discourseGroupPost struct {
 }
 
 // Users
-func (s *syncer) discourseGetPendingUsers() ([]discourseUser, error) {
+func (s *syncer) discourseGetPendingUsers(ctx context.Context) ([]discourseUser, error) {
 	users := []discourseUser{}
 
-	err := s.queryStruct("discourse", "GET", "/admin/users/list/pending.json", nil, &users, nil)
+	err := s.queryStruct(ctx, "discourse", "GET", "/admin/users/list/pending.json", nil, &users, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -55,10 +143,10 @@ func (s *syncer) discourseGetPendingUsers() ([]discourseUser, error) {
 	return users, nil
 }
 
-func (s *syncer) discourseGetUser(id int64) (*discourseUser, error) {
+func (s *syncer) discourseGetUser(ctx context.Context, id int64) (*discourseUser, error) {
 	user := discourseUser{}
 
-	err := s.queryStruct("discourse", "GET", fmt.Sprintf("/admin/users/%d.json", id), nil, &user, nil)
+	err := s.queryStruct(ctx, "discourse", "GET", fmt.Sprintf("/admin/users/%d.json", id), nil, &user, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -66,12 +154,30 @@ func (s *syncer) discourseGetUser(id int64) (*discourseUser, error) {
 	return &user, nil
 }
 
+func (s *syncer) discourseGetUserFields(ctx context.Context, username string) (map[string]string, error) {
+	// For some reason the response is wrapped
+	user := map[string]discourseUser{}
+
+	err := s.queryStruct(ctx, "discourse", "GET", fmt.Sprintf("/u/%s.json", username), nil, &user, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unwrap the response
+	fields := user["user"].UserFields
+	if fields == nil {
+		fields = map[string]string{}
+	}
+
+	return fields, nil
+}
+
 // Groups
-func (s *syncer) discourseGetGroup(name string) (*discourseGroup, error) {
+func (s *syncer) discourseGetGroup(ctx context.Context, name string) (*discourseGroup, error) {
 	// For some reason the response is wrapped
 	group := map[string]discourseGroup{}
 
-	err := s.queryStruct("discourse", "GET", fmt.Sprintf("/groups/%s.json", name), nil, &group, nil)
+	err := s.queryStruct(ctx, "discourse", "GET", fmt.Sprintf("/groups/%s.json", name), nil, &group, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -82,7 +188,55 @@ func (s *syncer) discourseGetGroup(name string) (*discourseGroup, error) {
 	return &entry, nil
 }
 
-func (s *syncer) discourseCreateGroup(name string, fullName string) (int64, error) {
+func (s *syncer) discourseGetGroupMembers(ctx context.Context, name string) ([]discourseUser, error) {
+	members := []discourseUser{}
+
+	for {
+		resp := struct {
+			Members []discourseUser `json:"members"`
+		}{}
+
+		err := s.queryStruct(ctx, "discourse", "GET", fmt.Sprintf("/groups/%s/members.json?limit=50&offset=%d", name, len(members)), nil, &resp, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		members = append(members, resp.Members...)
+		if len(resp.Members) < 50 {
+			break
+		}
+	}
+
+	return members, nil
+}
+
+func (s *syncer) discourseAddGroupMember(ctx context.Context, id int64, username string) error {
+	member := map[string]string{
+		"usernames": username,
+	}
+
+	err := s.queryStruct(ctx, "discourse", "PUT", fmt.Sprintf("/groups/%d/members.json", id), member, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *syncer) discourseRemoveGroupMember(ctx context.Context, id int64, username string) error {
+	member := map[string]string{
+		"usernames": username,
+	}
+
+	err := s.queryStruct(ctx, "discourse", "DELETE", fmt.Sprintf("/groups/%d/members.json", id), member, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *syncer) discourseCreateGroup(ctx context.Context, name string, fullName string) (int64, error) {
 	title := ""
 	if fullName == "" {
 		fullName = name
@@ -99,7 +253,7 @@ func (s *syncer) discourseCreateGroup(name string, fullName string) (int64, erro
 	}
 
 	var resp interface{}
-	err := s.queryStruct("discourse", "POST", "/admin/groups/", group, &resp, nil)
+	err := s.queryStruct(ctx, "discourse", "POST", "/admin/groups/", group, &resp, nil)
 	if err != nil {
 		return -1, err
 	}
@@ -107,8 +261,8 @@ func (s *syncer) discourseCreateGroup(name string, fullName string) (int64, erro
 	return int64(resp.(map[string]interface{})["basic_group"].(map[string]interface{})["id"].(float64)), nil
 }
 
-func (s *syncer) discourseDeleteGroup(id int64) error {
-	err := s.queryStruct("discourse", "DELETE", fmt.Sprintf("/admin/groups/%d", id), nil, nil, nil)
+func (s *syncer) discourseDeleteGroup(ctx context.Context, id int64) error {
+	err := s.queryStruct(ctx, "discourse", "DELETE", fmt.Sprintf("/admin/groups/%d", id), nil, nil, nil)
 	if err != nil {
 		return err
 	}
@@ -116,7 +270,7 @@ func (s *syncer) discourseDeleteGroup(id int64) error {
 	return nil
 }
 
-func (s *syncer) discourseUpdateGroup(id int64, name string, fullName string) error {
+func (s *syncer) discourseUpdateGroup(ctx context.Context, id int64, name string, fullName string) error {
 	title := ""
 	if fullName == "" {
 		fullName = name
@@ -126,11 +280,12 @@ func (s *syncer) discourseUpdateGroup(id int64, name string, fullName string) er
 	}
 
 	group := discourseGroupPost{
+		Name:     name,
 		FullName: fullName,
 		Title:    title,
 	}
 
-	err := s.queryStruct("discourse", "PUT", fmt.Sprintf("/groups/%v", id), group, nil, nil)
+	err := s.queryStruct(ctx, "discourse", "PUT", fmt.Sprintf("/groups/%v", id), group, nil, nil)
 	if err != nil {
 		return err
 	}
@@ -139,23 +294,175 @@ func (s *syncer) discourseUpdateGroup(id int64, name string, fullName string) er
 }
 
 // Categories
-func (s *syncer) discourseCreateCategory(name string, groups []string) (int64, error) {
+func (s *syncer) discourseGetCategoryByName(ctx context.Context, name string) (int64, error) {
+	var resp interface{}
+	err := s.queryStruct(ctx, "discourse", "GET", "/categories.json?include_subcategories=true", nil, &resp, nil)
+	if err != nil {
+		return -1, err
+	}
+
+	// Look through the categories and their subcategories
+	var find func(categories []interface{}) int64
+	find = func(categories []interface{}) int64 {
+		for _, entry := range categories {
+			category := entry.(map[string]interface{})
+			if category["name"] == name || category["slug"] == name {
+				return int64(category["id"].(float64))
+			}
+
+			subcategories, ok := category["subcategory_list"].([]interface{})
+			if ok {
+				id := find(subcategories)
+				if id != -1 {
+					return id
+				}
+			}
+		}
+
+		return -1
+	}
+
+	return find(resp.(map[string]interface{})["category_list"].(map[string]interface{})["categories"].([]interface{})), nil
+}
+
+// discourseGetTeamCategory returns the ID of the existing category of a team,
+// or -1. Categories which don't grant access to the team group are the site's
+// own and are never considered as the team's.
+func (s *syncer) discourseGetTeamCategory(ctx context.Context, name string) (int64, error) {
+	id, err := s.discourseGetCategoryByName(ctx, name)
+	if err != nil || id == -1 {
+		return id, err
+	}
+
+	groups, err := s.discourseGetCategoryGroups(ctx, id)
+	if err != nil {
+		return -1, err
+	}
+
+	if !stringInSlice(name, groups) {
+		return -1, fmt.Errorf("Category %s already exists and doesn't belong to the team", name)
+	}
+
+	return id, nil
+}
+
+func (s *syncer) discourseGetCategoryGroups(ctx context.Context, id int64) ([]string, error) {
+	resp := struct {
+		Category struct {
+			GroupPermissions []struct {
+				GroupName string `json:"group_name"`
+			} `json:"group_permissions"`
+		} `json:"category"`
+	}{}
+
+	err := s.queryStruct(ctx, "discourse", "GET", fmt.Sprintf("/c/%d/show.json", id), nil, &resp, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []string{}
+	for _, permission := range resp.Category.GroupPermissions {
+		groups = append(groups, permission.GroupName)
+	}
+
+	return groups, nil
+}
+
+// discourseTeamCategory returns the category settings for a team.
+func (s *syncer) discourseTeamCategory(ctx context.Context, slug string, title string, appearance teamAppearance, archived bool) (discourseCategoryPost, error) {
+	if title == "" {
+		title = slug
+	}
+
+	appearance = s.appearanceOrDefault(appearance)
+
+	parent, err := s.discourseResolveCategory(ctx, appearance.Parent)
+	if err != nil {
+		return discourseCategoryPost{}, err
+	}
+
+	// Render the name and description
+	data := struct {
+		Name string
+		Slug string
+	}{title, slug}
+
+	name := bytes.Buffer{}
+	err = s.config.categoryName.Execute(&name, data)
+	if err != nil {
+		return discourseCategoryPost{}, err
+	}
+
+	description := bytes.Buffer{}
+	err = s.config.categoryDescription.Execute(&description, data)
+	if err != nil {
+		return discourseCategoryPost{}, err
+	}
+
 	category := discourseCategoryPost{
-		Name:           name,
-		Color:          s.config.CategoryColor,
-		TextColor:      s.config.CategoryTextColor,
-		ParentCategory: s.config.CategoryParent,
+		Name:           name.String(),
+		Slug:           slug,
+		Description:    description.String(),
+		Color:          appearance.Color,
+		TextColor:      appearance.TextColor,
+		ParentCategory: parent,
+	}
+
+	// Archived teams are moved out of the way
+	if archived {
+		category.ParentCategory, err = s.discourseResolveCategory(ctx, s.config.ArchiveCategoryParent)
+		if err != nil {
+			return discourseCategoryPost{}, err
+		}
+	}
+
+	return category, nil
+}
+
+// discourseTeamPermissions returns the category permissions for a team. They
+// are only sent when they change so edits made on discourse are preserved.
+func (s *syncer) discourseTeamPermissions(slug string, archived bool) map[string]string {
+	// Archived teams can only read their category
+	permission := "1"
+	if archived {
+		permission = "3"
 	}
 
 	permissions := map[string]string{}
-	groups = append(groups, s.config.CategoryAccess...)
-	for _, group := range groups {
+	for _, group := range s.config.CategoryAccess {
 		permissions[group] = "1"
 	}
-	category.Permissions = permissions
+	permissions[slug] = permission
+
+	return permissions
+}
+
+// discourseResolveCategory turns a category slug or name into its ID.
+func (s *syncer) discourseResolveCategory(ctx context.Context, category string) (string, error) {
+	if category == "" {
+		return "", nil
+	}
+
+	_, err := strconv.ParseInt(category, 10, 64)
+	if err == nil {
+		return category, nil
+	}
+
+	id, err := s.discourseGetCategoryByName(ctx, category)
+	if err != nil {
+		return "", err
+	}
+
+	if id == -1 {
+		return "", fmt.Errorf("Category doesn't exist: %s", category)
+	}
 
+	return fmt.Sprintf("%d", id), nil
+}
+
+func (s *syncer) discourseCreateCategory(ctx context.Context, category discourseCategoryPost) (int64, error) {
 	var resp interface{}
-	err := s.queryStruct("discourse", "POST", "/categories", category, &resp, nil)
+	err := s.queryStruct(ctx, "discourse", "POST", "/categories", category, &resp, nil)
 	if err != nil {
 		return -1, err
 	}
@@ -163,17 +470,26 @@ func (s *syncer) discourseCreateCategory(name string, groups []string) (int64, e
 	return int64(resp.(map[string]interface{})["category"].(map[string]interface{})["id"].(float64)), nil
 }
 
-func (s *syncer) discourseDeleteCategory(id int64, name string) error {
-	topics, err := s.discourseGetTopics(id)
+func (s *syncer) discourseUpdateCategory(ctx context.Context, id int64, category discourseCategoryPost) error {
+	err := s.queryStruct(ctx, "discourse", "PUT", fmt.Sprintf("/categories/%d", id), category, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *syncer) discourseDeleteCategory(ctx context.Context, id int64, name string) error {
+	topics, err := s.discourseGetTopics(ctx, id)
 	if err != nil {
 		return err
 	}
 
 	for _, topic := range topics {
-		s.discourseDeleteTopic(topic)
+		s.discourseDeleteTopic(ctx, topic)
 	}
 
-	err = s.queryStruct("discourse", "DELETE", fmt.Sprintf("/categories/%d", id), nil, nil, nil)
+	err = s.queryStruct(ctx, "discourse", "DELETE", fmt.Sprintf("/categories/%d", id), nil, nil, nil)
 	if err != nil {
 		return err
 	}
@@ -182,23 +498,69 @@ func (s *syncer) discourseDeleteCategory(id int64, name string) error {
 }
 
 // Topics
-func (s *syncer) discourseGetTopics(id int64) ([]int64, error) {
+type discourseTopic struct {
+	ID        int64     `json:"id"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s *syncer) discourseGetTopics(ctx context.Context, id int64) ([]int64, error) {
+	topics, err := s.discourseGetCategoryTopics(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []int64{}
+	for _, topic := range topics {
+		ids = append(ids, topic.ID)
+	}
+
+	return ids, nil
+}
+
+func (s *syncer) discourseGetCategoryTopics(ctx context.Context, id int64) ([]discourseTopic, error) {
+	topics := []discourseTopic{}
+
+	// The topics are listed a page at a time
+	for page := 0; ; page++ {
+		resp := struct {
+			TopicList struct {
+				MoreTopicsURL string           `json:"more_topics_url"`
+				Topics        []discourseTopic `json:"topics"`
+			} `json:"topic_list"`
+		}{}
+
+		err := s.queryStruct(ctx, "discourse", "GET", fmt.Sprintf("/c/%d.json?page=%d", id, page), nil, &resp, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		topics = append(topics, resp.TopicList.Topics...)
+		if len(resp.TopicList.Topics) == 0 || resp.TopicList.MoreTopicsURL == "" {
+			break
+		}
+	}
+
+	return topics, nil
+}
+
+func (s *syncer) discourseGetTopicPosts(ctx context.Context, id int64) ([]int64, error) {
 	var resp interface{}
-	err := s.queryStruct("discourse", "GET", fmt.Sprintf("/c/%d.json", id), nil, &resp, nil)
+	err := s.queryStruct(ctx, "discourse", "GET", fmt.Sprintf("/t/%d.json", id), nil, &resp, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	// Parse the response
-	topics := []int64{}
-	for _, entry := range resp.(map[string]interface{})["topic_list"].(map[string]interface{})["topics"].([]interface{}) {
-		topics = append(topics, int64(entry.(map[string]interface{})["id"].(float64)))
+	posts := []int64{}
+	for _, entry := range resp.(map[string]interface{})["post_stream"].(map[string]interface{})["stream"].([]interface{}) {
+		posts = append(posts, int64(entry.(float64)))
 	}
 
-	return topics, nil
+	return posts, nil
 }
 
-func (s *syncer) discourseCreateTopicAs(category int64, title string, body string, apiUser string, apiKey string) (int64, error) {
+func (s *syncer) discourseCreateTopicAs(ctx context.Context, category int64, title string, body string, apiUser string, apiKey string) (int64, error) {
 	post := map[string]interface{}{
 		"category": category,
 		"title":    title,
@@ -216,7 +578,7 @@ func (s *syncer) discourseCreateTopicAs(category int64, title string, body strin
 		discourseKey:  apiKey,
 	}
 
-	err := s.queryStruct("discourse", "POST", "/posts", post, &resp, &args)
+	err := s.queryStruct(ctx, "discourse", "POST", "/posts", post, &resp, &args)
 	if err != nil {
 		return -1, err
 	}
@@ -224,10 +586,10 @@ func (s *syncer) discourseCreateTopicAs(category int64, title string, body strin
 	return int64(resp.(map[string]interface{})["topic_id"].(float64)), nil
 }
 
-func (s *syncer) discourseDeleteTopic(id int64) error {
-	origErr := s.queryStruct("discourse", "DELETE", fmt.Sprintf("/t/%d.json", id), nil, nil, nil)
+func (s *syncer) discourseDeleteTopic(ctx context.Context, id int64) error {
+	origErr := s.queryStruct(ctx, "discourse", "DELETE", fmt.Sprintf("/t/%d.json", id), nil, nil, nil)
 	if origErr != nil {
-		err := s.queryStruct("discourse", "DELETE", fmt.Sprintf("/posts/%d", id), nil, nil, nil)
+		err := s.queryStruct(ctx, "discourse", "DELETE", fmt.Sprintf("/posts/%d", id), nil, nil, nil)
 		if err != nil {
 			return origErr
 		}
@@ -238,7 +600,17 @@ func (s *syncer) discourseDeleteTopic(id int64) error {
 }
 
 // Posts
-func (s *syncer) discourseCreatePostAs(topic int64, body string, apiUser string, apiKey string) (int64, error) {
+func (s *syncer) discourseDeletePost(ctx context.Context, id int64) error {
+	err := s.queryStruct(ctx, "discourse", "DELETE", fmt.Sprintf("/posts/%d", id), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("Deleted post", log15.Ctx{"id": id})
+	return nil
+}
+
+func (s *syncer) discourseCreatePostAs(ctx context.Context, topic int64, body string, apiUser string, apiKey string) (int64, error) {
 	post := map[string]interface{}{
 		"topic_id": topic,
 		"raw":      body,
@@ -254,7 +626,7 @@ func (s *syncer) discourseCreatePostAs(topic int64, body string, apiUser string,
 		discourseKey:  apiKey,
 	}
 
-	err := s.queryStruct("discourse", "POST", "/posts", post, &resp, &args)
+	err := s.queryStruct(ctx, "discourse", "POST", "/posts", post, &resp, &args)
 	if err != nil {
 		return -1, err
 	}
@@ -262,135 +634,718 @@ func (s *syncer) discourseCreatePostAs(topic int64, body string, apiUser string,
 	return int64(resp.(map[string]interface{})["id"].(float64)), nil
 }
 
-// User setup
-func (s *syncer) discourseSetupUser(user discourseUser, group string) error {
-	// Setup the groups
-	adminGroup, err := s.discourseGetGroup(group)
+type discoursePost struct {
+	ID        int64     `json:"id"`
+	Raw       string    `json:"raw"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s *syncer) discourseGetPost(ctx context.Context, id int64) (*discoursePost, error) {
+	post := discoursePost{}
+
+	err := s.queryStruct(ctx, "discourse", "GET", fmt.Sprintf("/posts/%d.json", id), nil, &post, nil)
 	if err != nil {
-		return fmt.Errorf("User group doesn't exist: %s", group)
+		return nil, err
 	}
 
-	// Add the user to the group
-	member := map[string]string{
-		"usernames": user.Username,
+	return &post, nil
+}
+
+func (s *syncer) discourseUpdatePostAs(ctx context.Context, id int64, body string, apiUser string, apiKey string) error {
+	post := map[string]interface{}{
+		"post": map[string]interface{}{
+			"raw": body,
+		},
 	}
 
-	err = s.queryStruct("discourse", "PUT", fmt.Sprintf("/groups/%d/members.json", adminGroup.ID), member, nil, nil)
-	if err != nil {
-		return errors.Wrap(err, fmt.Sprintf("Failed to update groups for '%s'", user.Username))
+	if apiKey == "" {
+		apiKey = s.config.DiscourseAPIKey
 	}
 
-	// Approve the user
-	err = s.queryStruct("discourse", "PUT", fmt.Sprintf("/admin/users/%d/approve", user.ID), nil, nil, nil)
+	args := queryArgs{
+		discourseUser: apiUser,
+		discourseKey:  apiKey,
+	}
+
+	err := s.queryStruct(ctx, "discourse", "PUT", fmt.Sprintf("/posts/%d.json", id), post, nil, &args)
 	if err != nil {
-		return errors.Wrap(err, fmt.Sprintf("Failed to approve '%s'", user.Username))
+		return err
 	}
 
 	return nil
 }
 
-func (s *syncer) discourseProcessNewUsers() error {
-	// Get all users
-	users, err := s.discourseGetPendingUsers()
+func (s *syncer) discourseGetTopicFirstPost(ctx context.Context, id int64) (int64, error) {
+	var resp interface{}
+	err := s.queryStruct(ctx, "discourse", "GET", fmt.Sprintf("/t/%d.json", id), nil, &resp, nil)
 	if err != nil {
-		return err
+		return -1, err
 	}
 
-	for _, entry := range users {
-		// Pull the full entry
-		user, err := s.discourseGetUser(entry.ID)
-		if err != nil {
-			return err
-		}
-
-		// We only care about those that can be approved
-		if !user.CanApprove {
-			continue
-		}
-
-		// Get a full user record (including IP)
-		adminUser, err := s.discourseGetUser(user.ID)
-		if err != nil {
-			s.logger.Error("Failed to get full user record", log15.Ctx{"user": user.Username, "error": err})
-			continue
-		}
-
-		// Find what team they belong to
-		team, err := s.askgodTeamForIP(adminUser.RegistrationIPAddress)
-		if err != nil {
-			s.logger.Error("Failed to find team for IP", log15.Ctx{"user": adminUser.Username, "ip": adminUser.RegistrationIPAddress, "error": err})
-			continue
-		}
-
-		// Activate the user
-		err = s.discourseSetupUser(*adminUser, team.Tags["discourse"])
-		if err != nil {
-			s.logger.Error("Failed to setup new user", log15.Ctx{"user": adminUser.Username, "error": err})
-			continue
-		}
-
-		s.logger.Info("Activated new user", log15.Ctx{"user": adminUser.Username})
+	// Parse the response
+	posts := resp.(map[string]interface{})["post_stream"].(map[string]interface{})["posts"].([]interface{})
+	if len(posts) == 0 {
+		return -1, fmt.Errorf("Topic %d has no posts", id)
 	}
 
-	return nil
+	return int64(posts[0].(map[string]interface{})["id"].(float64)), nil
 }
 
-// Team setup
-func (s *syncer) discourseCreateTeam(name string, id int64, title string) error {
-	// Create the group
-	groupID, err := s.discourseCreateGroup(name, title)
+func (s *syncer) discourseUpdateTopicAs(ctx context.Context, id int64, title string, body string, apiUser string, apiKey string) error {
+	// Update the title
+	err := s.discourseUpdateTopicTitleAs(ctx, id, title, apiUser, apiKey)
 	if err != nil {
 		return err
 	}
 
-	// Create the category
-	categoryID, err := s.discourseCreateCategory(name, []string{name})
+	// Update the body
+	postID, err := s.discourseGetTopicFirstPost(ctx, id)
 	if err != nil {
 		return err
 	}
 
-	// Setup the DB entry
-	err = s.dbCreateTeam(id, title, name, groupID, categoryID)
-	if err != nil {
-		return err
+	return s.discourseUpdatePostAs(ctx, postID, body, apiUser, apiKey)
+}
+
+func (s *syncer) discourseUpdateTopicTitleAs(ctx context.Context, id int64, title string, apiUser string, apiKey string) error {
+	topic := map[string]interface{}{
+		"title": title,
 	}
 
-	s.logger.Info("Created new team", log15.Ctx{"name": name, "title": title})
-	return nil
-}
+	if apiKey == "" {
+		apiKey = s.config.DiscourseAPIKey
+	}
 
-func (s *syncer) discourseRenameTeam(name string, groupID int64, title string) error {
-	// Set the fullName and title
-	err := s.discourseUpdateGroup(groupID, name, title)
-	if err != nil {
-		return err
+	args := queryArgs{
+		discourseUser: apiUser,
+		discourseKey:  apiKey,
 	}
 
-	// Update the DB state
-	err = s.dbRenameTeam(groupID, title)
+	err := s.queryStruct(ctx, "discourse", "PUT", fmt.Sprintf("/t/-/%d.json", id), topic, nil, &args)
 	if err != nil {
 		return err
 	}
 
-	s.logger.Info("Renamed team", log15.Ctx{"name": name, "title": title})
 	return nil
 }
 
-func (s *syncer) discourseDeleteTeam(name string, groupID int64, categoryID int64) error {
-	// Delete the category
-	err := s.discourseDeleteCategory(categoryID, name)
+// User setup
+func (s *syncer) discourseSetupUser(ctx context.Context, user discourseUser, group string) error {
+	// Setup the groups
+	adminGroup, err := s.discourseGetGroup(ctx, group)
 	if err != nil {
-		return err
+		return fmt.Errorf("User group doesn't exist: %s", group)
 	}
 
-	// Delete the group
-	err = s.discourseDeleteGroup(groupID)
+	// Add the user to the group
+	err = s.discourseAddGroupMember(ctx, adminGroup.ID, user.Username)
 	if err != nil {
-		return err
+		return errors.Wrap(err, fmt.Sprintf("Failed to update groups for '%s'", user.Username))
 	}
 
-	// Setup the DB entry
-	err = s.dbDeleteTeam(name, groupID, categoryID)
+	// Approve the user
+	err = s.queryStruct(ctx, "discourse", "PUT", fmt.Sprintf("/admin/users/%d/approve", user.ID), nil, nil, nil)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Failed to approve '%s'", user.Username))
+	}
+
+	return nil
+}
+
+func (s *syncer) discourseProcessNewUsers(ctx context.Context) error {
+	// Get all users
+	users, err := s.discourseGetPendingUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(users) == 0 {
+		return nil
+	}
+
+	// Get all the teams
+	teams, err := s.askgodGetTeams(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.usersLock.Lock()
+	defer s.usersLock.Unlock()
+
+	for _, entry := range users {
+		err := s.discourseProcessUser(ctx, entry.ID, teams)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *syncer) discourseProcessUser(ctx context.Context, id int64, teams []api.AdminTeam) error {
+	// Pull the full entry
+	user, err := s.discourseGetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// We only care about those that can be approved
+	if !user.CanApprove {
+		return nil
+	}
+
+	// Get a full user record (including IP)
+	adminUser, err := s.discourseGetUser(ctx, user.ID)
+	if err != nil {
+		s.logger.Error("Failed to get full user record", log15.Ctx{"user": user.Username, "error": err})
+		return nil
+	}
+
+	// The invite code is only exposed on the public profile
+	if stringInSlice("invite", s.config.Membership) && adminUser.UserFields == nil {
+		adminUser.UserFields, err = s.discourseGetUserFields(ctx, adminUser.Username)
+		if err != nil {
+			s.logger.Error("Failed to get user fields", log15.Ctx{"user": user.Username, "error": err})
+			return nil
+		}
+	}
+
+	// Find what team they belong to
+	team, err := s.askgodTeamForUser(*adminUser, teams)
+	if err != nil {
+		err = s.discourseProcessUnmatchedUser(ctx, *adminUser, err)
+		if err != nil {
+			s.logger.Error("Failed to process unmatched user", log15.Ctx{"user": adminUser.Username, "error": err})
+		}
+
+		return nil
+	}
+
+	// Check that the team has room left
+	limit := s.teamMemberLimit(*team)
+	if limit > 0 {
+		group, err := s.discourseGetGroup(ctx, team.Tags["discourse"])
+		if err != nil {
+			s.logger.Error("Failed to get team group", log15.Ctx{"team": team.Tags["discourse"], "error": err})
+			return nil
+		}
+
+		if group.UserCount >= limit {
+			err = s.discourseProcessFullTeam(ctx, *adminUser, team.Tags["discourse"], limit)
+			if err != nil {
+				s.logger.Error("Failed to process over-limit user", log15.Ctx{"user": adminUser.Username, "error": err})
+			}
+
+			return nil
+		}
+	}
+
+	// Activate the user
+	err = s.discourseSetupUser(ctx, *adminUser, team.Tags["discourse"])
+	if err != nil {
+		s.logger.Error("Failed to setup new user", log15.Ctx{"user": adminUser.Username, "error": err})
+		return nil
+	}
+
+	s.logger.Info("Activated new user", log15.Ctx{"user": adminUser.Username})
+	metricUsers.WithLabelValues("approved").Inc()
+
+	// Forget any earlier report
+	err = s.dbDeleteUnmatchedUser(adminUser.ID)
+	if err != nil {
+		s.logger.Error("Failed to clear unmatched user", log15.Ctx{"user": adminUser.Username, "error": err})
+	}
+
+	return nil
+}
+
+func (s *syncer) discourseRejectUser(ctx context.Context, user discourseUser, reason string) error {
+	args := map[string]interface{}{
+		"context":      reason,
+		"delete_posts": true,
+	}
+
+	err := s.queryStruct(ctx, "discourse", "DELETE", fmt.Sprintf("/admin/users/%d.json", user.ID), args, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *syncer) discourseProcessUnmatchedUser(ctx context.Context, user discourseUser, reason error) error {
+	// Only deal with each user once
+	reported, err := s.dbUnmatchedUserReported(user.ID, "unmatched")
+	if err != nil {
+		return err
+	}
+
+	if reported {
+		s.logger.Debug("Pending user still matches no team", log15.Ctx{"user": user.Username})
+		return nil
+	}
+
+	s.logger.Warn("Failed to find team for user", log15.Ctx{"user": user.Username, "ip": user.RegistrationIPAddress, "error": reason, "policy": s.config.UnmatchedUsers})
+	metricUsers.WithLabelValues("unmatched").Inc()
+
+	if s.config.UnmatchedUsers == "reject" {
+		message := s.config.UnmatchedRejectReason
+		if message == "" {
+			message = fmt.Sprintf("No matching team: %v", reason)
+		}
+
+		err := s.discourseRejectUser(ctx, user, message)
+		if err != nil {
+			return err
+		}
+
+		s.logger.Info("Rejected unmatched user", log15.Ctx{"user": user.Username})
+	} else if s.config.UnmatchedUsers == "notify" {
+		title := fmt.Sprintf("Pending user %s matches no team", user.Username)
+		body := fmt.Sprintf("User **%s** is waiting for approval but doesn't match any team.\n\n* Email: %s\n* IP: %s\n* Reason: %v",
+			user.Username, user.Email, user.RegistrationIPAddress, reason)
+
+		err := s.discourseNotifyAdmins(ctx, title, body)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.dbCreateUnmatchedUser(user.ID, user.Username, "unmatched")
+}
+
+func (s *syncer) discourseProcessFullTeam(ctx context.Context, user discourseUser, team string, limit int64) error {
+	// Only report each user once
+	reported, err := s.dbUnmatchedUserReported(user.ID, "team-full")
+	if err != nil {
+		return err
+	}
+
+	if reported {
+		s.logger.Debug("Pending user's team is still full", log15.Ctx{"user": user.Username, "team": team})
+		return nil
+	}
+
+	s.logger.Warn("Team is at its member limit, leaving user pending", log15.Ctx{"user": user.Username, "team": team, "limit": limit})
+	metricUsers.WithLabelValues("team_full").Inc()
+
+	if s.config.UnmatchedCategory != "" {
+		title := fmt.Sprintf("Pending user %s exceeds the member limit of %s", user.Username, team)
+		body := fmt.Sprintf("User **%s** matches team **%s** which already has %d members.\n\n* Email: %s\n* IP: %s",
+			user.Username, team, limit, user.Email, user.RegistrationIPAddress)
+
+		err := s.discourseNotifyAdmins(ctx, title, body)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.dbCreateUnmatchedUser(user.ID, user.Username, "team-full")
+}
+
+func (s *syncer) discourseNotifyAdmins(ctx context.Context, title string, body string) error {
+	categoryID, err := s.discourseResolveCategory(ctx, s.config.UnmatchedCategory)
+	if err != nil {
+		return err
+	}
+
+	category, err := strconv.ParseInt(categoryID, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.discourseCreateTopicAs(ctx, category, title, body, "", "")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *syncer) discourseReconcileMembers(ctx context.Context) error {
+	// Memberships mustn't change under us, new users are approved afterwards
+	s.usersLock.Lock()
+	defer s.usersLock.Unlock()
+
+	// Get all the teams
+	teams, err := s.askgodGetTeams(ctx)
+	if err != nil {
+		return err
+	}
+
+	dbTeams, err := s.dbGetTeams()
+	if err != nil {
+		return err
+	}
+
+	// Map every user to the team groups they're in
+	groupIDs := map[string]int64{}
+	userGroups := map[string][]string{}
+	userIDs := map[string]int64{}
+	for _, team := range dbTeams {
+		if !team.provisioned() || team.Archived {
+			continue
+		}
+
+		groupIDs[team.DiscourseName] = team.DiscourseGroupID
+
+		members, err := s.discourseGetGroupMembers(ctx, team.DiscourseName)
+		if err != nil {
+			return err
+		}
+
+		for _, member := range members {
+			userGroups[member.Username] = append(userGroups[member.Username], team.DiscourseName)
+			userIDs[member.Username] = member.ID
+		}
+	}
+
+	for username, groups := range userGroups {
+		// Get a full user record (including IP)
+		user, err := s.discourseGetUser(ctx, userIDs[username])
+		if err != nil {
+			s.logger.Error("Failed to get full user record", log15.Ctx{"user": username, "error": err})
+			continue
+		}
+
+		// Staff can be in whatever group they want
+		if user.Admin || user.Moderator {
+			continue
+		}
+
+		if stringInSlice("invite", s.config.Membership) && user.UserFields == nil {
+			user.UserFields, err = s.discourseGetUserFields(ctx, username)
+			if err != nil {
+				s.logger.Error("Failed to get user fields", log15.Ctx{"user": username, "error": err})
+				continue
+			}
+		}
+
+		// Find what team they should be in
+		expected := ""
+		team, err := s.askgodTeamForUser(*user, teams)
+		if err == nil {
+			expected = team.Tags["discourse"]
+		}
+
+		// Only one group, the right one or one we can't know better than
+		if len(groups) == 1 && (expected == "" || groups[0] == expected) {
+			// Forget any earlier report, should it happen again
+			err := s.dbDeleteUnmatchedUser(user.ID)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		// Only report each situation once
+		reason := fmt.Sprintf("membership:%s:%s", strings.Join(groups, ","), expected)
+		reported, err := s.dbUnmatchedUserReported(user.ID, reason)
+		if err != nil {
+			return err
+		}
+
+		if reported {
+			s.logger.Debug("Team membership still wrong", log15.Ctx{"user": username, "groups": strings.Join(groups, ","), "expected": expected})
+		} else {
+			s.logger.Warn("Wrong team membership", log15.Ctx{"user": username, "groups": strings.Join(groups, ","), "expected": expected})
+
+			err = s.dbCreateUnmatchedUser(user.ID, username, reason)
+			if err != nil {
+				return err
+			}
+		}
+
+		if s.config.MembershipReconcile != "fix" || expected == "" {
+			continue
+		}
+
+		// Fix the membership
+		for _, group := range groups {
+			if group == expected {
+				continue
+			}
+
+			err := s.discourseRemoveGroupMember(ctx, groupIDs[group], username)
+			if err != nil {
+				s.logger.Error("Failed to remove user from group", log15.Ctx{"user": username, "group": group, "error": err})
+				continue
+			}
+
+			s.logger.Info("Removed user from group", log15.Ctx{"user": username, "group": group})
+		}
+
+		if !stringInSlice(expected, groups) {
+			groupID, ok := groupIDs[expected]
+			if !ok {
+				continue
+			}
+
+			err := s.discourseAddGroupMember(ctx, groupID, username)
+			if err != nil {
+				s.logger.Error("Failed to add user to group", log15.Ctx{"user": username, "group": expected, "error": err})
+				continue
+			}
+
+			s.logger.Info("Added user to group", log15.Ctx{"user": username, "group": expected})
+		}
+	}
+
+	return nil
+}
+
+// Team setup
+func (s *syncer) discourseCreateTeam(ctx context.Context, name string, id int64, title string, appearance teamAppearance) error {
+	// Record the team first so an interrupted setup can be resumed
+	err := s.dbCreateTeam(id, title, name, 0, 0, appearance)
+	if err != nil {
+		return err
+	}
+
+	team := dbTeam{
+		AskgodID:      id,
+		AskgodName:    title,
+		DiscourseName: name,
+		Color:         appearance.Color,
+		TextColor:     appearance.TextColor,
+		Parent:        appearance.Parent,
+	}
+
+	_, err = s.discourseProvisionTeam(ctx, team, false)
+	return err
+}
+
+// discourseProvisionTeam creates the missing group and category of a team,
+// returning the updated team. When resuming an interrupted setup, the
+// objects left behind by the previous attempt are adopted instead.
+func (s *syncer) discourseProvisionTeam(ctx context.Context, team dbTeam, resume bool) (dbTeam, error) {
+	name := team.DiscourseName
+	title := team.AskgodName
+
+	// Setup the group
+	if team.DiscourseGroupID == 0 {
+		var group *discourseGroup
+		if resume {
+			var err error
+			group, err = s.discourseGetGroup(ctx, name)
+			if err != nil && !isNotFound(err) {
+				return team, err
+			}
+		}
+
+		if group != nil && group.ID != 0 {
+			// Only adopt what we could have created, not one of the site's groups
+			fullName := title
+			if fullName == "" {
+				fullName = name
+			}
+
+			if group.FullName != fullName {
+				return team, fmt.Errorf("Group %s already exists and doesn't belong to the team", name)
+			}
+
+			// Adopt the group left behind by a previous attempt
+			team.DiscourseGroupID = group.ID
+			s.logger.Info("Adopted existing group", log15.Ctx{"name": name, "id": group.ID})
+		} else {
+			groupID, err := s.discourse.createGroup(ctx, name, title)
+			if err != nil {
+				return team, err
+			}
+
+			team.DiscourseGroupID = groupID
+		}
+
+		err := s.dbUpdateTeamDiscourse(team.AskgodID, team.DiscourseGroupID, team.DiscourseCategoryID)
+		if err != nil {
+			return team, err
+		}
+	}
+
+	// Setup the category
+	if team.DiscourseCategoryID == 0 {
+		categoryID := int64(-1)
+		if resume {
+			var err error
+			categoryID, err = s.discourseGetTeamCategory(ctx, name)
+			if err != nil {
+				return team, err
+			}
+		}
+
+		if categoryID != -1 {
+			// Adopt the category left behind by a previous attempt
+			team.DiscourseCategoryID = categoryID
+			s.logger.Info("Adopted existing category", log15.Ctx{"name": name, "id": categoryID})
+		} else {
+			category, err := s.discourseTeamCategory(ctx, name, title, team.appearance(), false)
+			if err != nil {
+				return team, err
+			}
+			category.Permissions = s.discourseTeamPermissions(name, false)
+
+			categoryID, err := s.discourse.createCategory(ctx, category)
+			if err != nil {
+				return team, err
+			}
+
+			team.DiscourseCategoryID = categoryID
+		}
+
+		err := s.dbUpdateTeamDiscourse(team.AskgodID, team.DiscourseGroupID, team.DiscourseCategoryID)
+		if err != nil {
+			return team, err
+		}
+	}
+
+	s.logger.Info("Created new team", log15.Ctx{"name": name, "title": title})
+	return team, nil
+}
+
+func (s *syncer) discourseRenameTeam(ctx context.Context, team dbTeam, title string) error {
+	// Set the fullName and title
+	err := s.discourse.updateGroup(ctx, team.DiscourseGroupID, team.DiscourseName, title)
+	if err != nil {
+		return err
+	}
+
+	// Update the category name and description
+	category, err := s.discourseTeamCategory(ctx, team.DiscourseName, title, team.appearance(), team.Archived)
+	if err != nil {
+		return err
+	}
+
+	err = s.discourse.updateCategory(ctx, team.DiscourseCategoryID, category)
+	if err != nil {
+		return err
+	}
+
+	// Update the DB state
+	err = s.dbRenameTeam(team.AskgodID, title)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("Renamed team", log15.Ctx{"name": team.DiscourseName, "title": title})
+	return nil
+}
+
+func (s *syncer) discourseArchiveTeam(ctx context.Context, team dbTeam) error {
+	// Make the category read-only and move it out of the way
+	category, err := s.discourseTeamCategory(ctx, team.DiscourseName, team.AskgodName, team.appearance(), true)
+	if err != nil {
+		return err
+	}
+	category.Permissions = s.discourseTeamPermissions(team.DiscourseName, true)
+
+	err = s.discourse.updateCategory(ctx, team.DiscourseCategoryID, category)
+	if err != nil {
+		return err
+	}
+
+	// Update the DB state
+	err = s.dbArchiveTeam(team.AskgodID, true)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("Archived team", log15.Ctx{"name": team.DiscourseName})
+	return nil
+}
+
+func (s *syncer) discourseRestoreTeam(ctx context.Context, team dbTeam) error {
+	// Restore the category permissions and location
+	category, err := s.discourseTeamCategory(ctx, team.DiscourseName, team.AskgodName, team.appearance(), false)
+	if err != nil {
+		return err
+	}
+	category.Permissions = s.discourseTeamPermissions(team.DiscourseName, false)
+
+	err = s.discourse.updateCategory(ctx, team.DiscourseCategoryID, category)
+	if err != nil {
+		return err
+	}
+
+	// Update the DB state
+	err = s.dbArchiveTeam(team.AskgodID, false)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("Restored archived team", log15.Ctx{"name": team.DiscourseName})
+	return nil
+}
+
+func (s *syncer) discourseRetagTeam(ctx context.Context, team dbTeam, name string) error {
+	// Rename the group first as the category permissions refer to it
+	err := s.discourse.updateGroup(ctx, team.DiscourseGroupID, name, team.AskgodName)
+	if err != nil {
+		return err
+	}
+
+	// Rename the category
+	category, err := s.discourseTeamCategory(ctx, name, team.AskgodName, team.appearance(), team.Archived)
+	if err != nil {
+		return err
+	}
+
+	err = s.discourse.updateCategory(ctx, team.DiscourseCategoryID, category)
+	if err != nil {
+		return err
+	}
+
+	// Update the DB state
+	err = s.dbRetagTeam(team.AskgodID, name)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("Changed team tag", log15.Ctx{"old": team.DiscourseName, "name": name})
+	return nil
+}
+
+func (s *syncer) discourseRestyleTeam(ctx context.Context, team dbTeam, appearance teamAppearance) error {
+	// Update the category
+	category, err := s.discourseTeamCategory(ctx, team.DiscourseName, team.AskgodName, appearance, team.Archived)
+	if err != nil {
+		return err
+	}
+
+	err = s.discourse.updateCategory(ctx, team.DiscourseCategoryID, category)
+	if err != nil {
+		return err
+	}
+
+	// Update the DB state
+	err = s.dbUpdateTeamAppearance(team.AskgodID, appearance)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("Updated team appearance", log15.Ctx{"name": team.DiscourseName, "color": appearance.Color, "parent": appearance.Parent})
+	return nil
+}
+
+func (s *syncer) discourseDeleteTeam(ctx context.Context, name string, groupID int64, categoryID int64) error {
+	// Delete the category
+	if categoryID != 0 {
+		err := s.discourse.deleteCategory(ctx, categoryID, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Delete the group
+	if groupID != 0 {
+		err := s.discourse.deleteGroup(ctx, groupID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Setup the DB entry
+	err := s.dbDeleteTeam(name, groupID, categoryID)
 	if err != nil {
 		return err
 	}
@@ -399,16 +1354,23 @@ func (s *syncer) discourseDeleteTeam(name string, groupID int64, categoryID int6
 	return nil
 }
 
-func (s *syncer) discourseCreateTopic(name string, id int64, apiUser string, apiKey string, postName string, postCategory int64, postTitle string, postBody string) error {
+func (s *syncer) discourseCreateTopic(ctx context.Context, name string, id int64, apiUser string, apiKey string, postName string, postCategory int64, postTitle string, postBody string, postHash string) error {
+	// Record the intent so a crash can't lead to a duplicate
+	intentID, err := s.dbCreateIntent(id, postName, "topic", postCategory, postTitle, postHash)
+	if err != nil {
+		s.logger.Error("Failed to create topic", log15.Ctx{"err": err, "team": name, "name": postName})
+		return err
+	}
+
 	// Create the topic
-	topicID, err := s.discourseCreateTopicAs(postCategory, postTitle, postBody, apiUser, apiKey)
+	topicID, err := s.discourse.createTopic(ctx, postCategory, postTitle, postBody+intentMarker(intentID), apiUser, apiKey)
 	if err != nil {
 		s.logger.Error("Failed to create topic", log15.Ctx{"err": err, "team": name, "name": postName, "id": topicID})
 		return err
 	}
 
 	// Setup the DB entry
-	err = s.dbCreatePost(id, postName, topicID)
+	err = s.dbCompleteIntent(intentID, id, postName, topicID, postHash)
 	if err != nil {
 		s.logger.Error("Failed to create topic", log15.Ctx{"err": err, "team": name, "name": postName, "id": topicID})
 		return err
@@ -419,16 +1381,23 @@ func (s *syncer) discourseCreateTopic(name string, id int64, apiUser string, api
 
 }
 
-func (s *syncer) discourseCreatePost(name string, id int64, apiUser string, apiKey string, postName string, postID int64, postBody string) error {
+func (s *syncer) discourseCreatePost(ctx context.Context, name string, id int64, apiUser string, apiKey string, postName string, postID int64, postBody string, postHash string) error {
+	// Record the intent so a crash can't lead to a duplicate
+	intentID, err := s.dbCreateIntent(id, postName, "post", postID, "", postHash)
+	if err != nil {
+		s.logger.Error("Failed to create post", log15.Ctx{"err": err, "team": name, "name": postName})
+		return err
+	}
+
 	// Create the post
-	postID, err := s.discourseCreatePostAs(postID, postBody, apiUser, apiKey)
+	postID, err = s.discourse.createPost(ctx, postID, postBody+intentMarker(intentID), apiUser, apiKey)
 	if err != nil {
 		s.logger.Error("Failed to create post", log15.Ctx{"err": err, "team": name, "name": postName, "id": postID})
 		return err
 	}
 
 	// Setup the DB entry
-	err = s.dbCreatePost(id, postName, postID)
+	err = s.dbCompleteIntent(intentID, id, postName, postID, postHash)
 	if err != nil {
 		s.logger.Error("Failed to create post", log15.Ctx{"err": err, "team": name, "name": postName, "id": postID})
 		return err
@@ -437,3 +1406,122 @@ func (s *syncer) discourseCreatePost(name string, id int64, apiUser string, apiK
 	s.logger.Info("New post", log15.Ctx{"team": name, "name": postName, "id": postID})
 	return nil
 }
+
+// intentMarker is appended to new posts so they can be found again if the
+// DB entry couldn't be recorded. Discourse doesn't render HTML comments.
+func intentMarker(intentID int64) string {
+	return fmt.Sprintf("\n\n<!-- askgod-discourse:%d -->", intentID)
+}
+
+var intentMarkerPattern = regexp.MustCompile(`\n\n<!-- askgod-discourse:\d+ -->$`)
+
+// stripIntentMarker returns the body as it was before intentMarker was appended.
+func stripIntentMarker(body string) string {
+	return intentMarkerPattern.ReplaceAllString(body, "")
+}
+
+// intentClockSkew is how far the discourse clock may be behind ours.
+const intentClockSkew = 10 * time.Minute
+
+// discourseFindIntent looks for what an interrupted publication may have
+// posted, returning -1 if nothing carries its marker. Titles may have been
+// rewritten by discourse so only the marker is relied upon.
+func (s *syncer) discourseFindIntent(ctx context.Context, intent dbIntent) (int64, error) {
+	marker := strings.TrimSpace(intentMarker(intent.ID))
+
+	// Anything older than the intent can't be it
+	notBefore := time.Time{}
+	if !intent.CreatedAt.IsZero() {
+		notBefore = intent.CreatedAt.Add(-intentClockSkew)
+	}
+
+	if intent.Type == "topic" {
+		// Look through all the recent topics of the category
+		topics, err := s.discourseGetCategoryTopics(ctx, intent.DiscourseTargetID)
+		if err != nil {
+			return -1, err
+		}
+
+		for _, topic := range topics {
+			if topic.CreatedAt.Before(notBefore) {
+				continue
+			}
+
+			// Topics deleted meanwhile aren't it
+			postID, err := s.discourseGetTopicFirstPost(ctx, topic.ID)
+			if err != nil {
+				if isNotFound(err) {
+					continue
+				}
+
+				return -1, err
+			}
+
+			post, err := s.discourseGetPost(ctx, postID)
+			if err != nil {
+				if isNotFound(err) {
+					continue
+				}
+
+				return -1, err
+			}
+
+			if strings.Contains(post.Raw, marker) {
+				return topic.ID, nil
+			}
+		}
+
+		return -1, nil
+	}
+
+	// Look through the posts of the topic, most recent first
+	postIDs, err := s.discourseGetTopicPosts(ctx, intent.DiscourseTargetID)
+	if err != nil {
+		return -1, err
+	}
+
+	for i := len(postIDs) - 1; i >= 0; i-- {
+		post, err := s.discourseGetPost(ctx, postIDs[i])
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+
+			return -1, err
+		}
+
+		if strings.Contains(post.Raw, marker) {
+			return postIDs[i], nil
+		}
+
+		if post.CreatedAt.Before(notBefore) {
+			break
+		}
+	}
+
+	return -1, nil
+}
+
+func (s *syncer) discourseUpdateTopic(ctx context.Context, name string, apiUser string, apiKey string, postName string, topicID int64, postTitle string, postBody string) error {
+	// Update the topic
+	err := s.discourse.updateTopic(ctx, topicID, postTitle, postBody, apiUser, apiKey)
+	if err != nil {
+		s.logger.Error("Failed to update topic", log15.Ctx{"err": err, "team": name, "name": postName, "id": topicID})
+		return err
+	}
+
+	s.logger.Info("Updated topic", log15.Ctx{"team": name, "name": postName, "id": topicID})
+	return nil
+}
+
+func (s *syncer) discourseUpdatePost(ctx context.Context, name string, apiUser string, apiKey string, postName string, postID int64, postBody string) error {
+	// Update the body
+	err := s.discourse.updatePost(ctx, postID, postBody, apiUser, apiKey)
+	if err != nil {
+		s.logger.Error("Failed to update post", log15.Ctx{"err": err, "team": name, "name": postName, "id": postID})
+		return err
+	}
+
+	s.logger.Info("Updated post", log15.Ctx{"team": name, "name": postName, "id": postID})
+	return nil
+}
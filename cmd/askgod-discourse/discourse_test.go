@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestStripIntentMarker(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		stripped string
+	}{
+		{"marker", "Body" + intentMarker(42), "Body"},
+		{"no marker", "Body", "Body"},
+		{"quoted marker", "Body" + intentMarker(42) + "\n\nMore", "Body" + intentMarker(42) + "\n\nMore"},
+	}
+
+	for _, test := range tests {
+		stripped := stripIntentMarker(test.body)
+		if stripped != test.stripped {
+			t.Errorf("%s: expected %q, got %q", test.name, test.stripped, stripped)
+		}
+	}
+}
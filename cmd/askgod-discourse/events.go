@@ -1,17 +1,29 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/inconshreveable/log15"
 	"github.com/nsec/askgod/api"
 )
 
-func (s *syncer) setupEvents() (chan error, error) {
+const (
+	eventsPingInterval = 30 * time.Second
+	eventsPongTimeout  = 60 * time.Second
+	eventsMaxBackoff   = time.Minute
+)
+
+// setupEvents listens to askgod events until ctx is cancelled. The syncs
+// run under queryCtx so that a shutdown lets them complete.
+func (s *syncer) setupEvents(ctx context.Context, queryCtx context.Context) (chan error, error) {
 	chError := make(chan error, 1)
 
 	// Websocket connection
-	conn, err := s.websocket("askgod", "/events?type=flags,timeline")
+	conn, err := s.eventsConnect(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -19,67 +31,204 @@ func (s *syncer) setupEvents() (chan error, error) {
 	// Event handler
 	go func() {
 		for {
-			_, data, err := conn.ReadMessage()
+			err := s.eventsListen(ctx, queryCtx, conn)
+			s.setEventsConnected(false)
+
+			// Shutting down
+			if ctx.Err() != nil {
+				s.logger.Info("Disconnected from askgod events")
+				return
+			}
+
+			s.logger.Warn("Disconnected from askgod events", log15.Ctx{"error": err})
+
+			// Try to get back online
+			conn, err = s.eventsReconnect(ctx)
 			if err != nil {
-				// Got disconnected
+				if ctx.Err() != nil {
+					return
+				}
+
 				chError <- err
 				return
 			}
 
-			event := api.Event{}
-			err = json.Unmarshal(data, &event)
+			// Catch up with what we missed
+			s.logger.Info("Reconnected to askgod events, running catch-up sync")
+			err = s.syncTeams(queryCtx)
 			if err != nil {
-				s.logger.Error("Bad askgod event", log15.Ctx{"error": err})
-				continue
+				s.logger.Error("Failed to sync teams", log15.Ctx{"error": err})
 			}
 
-			s.logger.Debug("Received askgod event", log15.Ctx{"type": event.Type})
+			err = s.syncPosts(queryCtx)
+			if err != nil {
+				s.logger.Error("Failed to sync posts", log15.Ctx{"error": err})
+			}
+		}
+	}()
 
-			if event.Type == "flags" {
-				// Got a flag submission event
-				entry := api.EventFlag{}
-				err = json.Unmarshal(event.Metadata, &entry)
-				if err != nil {
-					s.logger.Error("Bad askgod flag event", log15.Ctx{"error": err})
-					continue
-				}
+	return chError, nil
+}
 
-				// We only care about valid flags
-				if entry.Type != "valid" {
-					continue
-				}
+func (s *syncer) eventsConnect(ctx context.Context) (*websocket.Conn, error) {
+	conn, err := s.websocket(ctx, "askgod", "/events?type=flags,timeline")
+	if err != nil {
+		return nil, err
+	}
 
-				// Update discourse
-				s.logger.Debug("Askgod triggered posts update")
-				err = s.syncPosts()
-				if err != nil {
-					s.logger.Error("Failed to sync teams", log15.Ctx{"error": err})
-					continue
-				}
-			} else if event.Type == "timeline" {
-				// Got a timeline event
-				entry := api.EventTimeline{}
-				err = json.Unmarshal(event.Metadata, &entry)
-				if err != nil {
-					s.logger.Error("Bad askgod timeline event", log15.Ctx{"error": err})
-					continue
-				}
+	// Detect dead connections through pings
+	conn.SetReadDeadline(time.Now().Add(eventsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(eventsPongTimeout))
+	})
 
-				// We only care about team events
-				if entry.Type != "team-added" && entry.Type != "team-removed" && entry.Type != "team-updated" {
-					continue
-				}
+	s.setEventsConnected(true)
+	return conn, nil
+}
+
+func (s *syncer) eventsReconnect(ctx context.Context) (*websocket.Conn, error) {
+	timeout := s.config.AskgodReconnectTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
 
-				// Update discourse
-				s.logger.Debug("Askgod triggered teams update", log15.Ctx{"type": entry.Type})
-				err = s.syncTeams()
+	start := time.Now()
+	backoff := time.Second
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		conn, err := s.eventsConnect(ctx)
+		if err == nil {
+			metricReconnects.Inc()
+			return conn, nil
+		}
+
+		if time.Since(start) > timeout {
+			return nil, fmt.Errorf("Failed to reconnect to askgod events after %v: %v", timeout, err)
+		}
+
+		s.logger.Warn("Failed to reconnect to askgod events", log15.Ctx{"error": err, "retry": backoff})
+
+		// Exponential backoff
+		backoff *= 2
+		if backoff > eventsMaxBackoff {
+			backoff = eventsMaxBackoff
+		}
+	}
+}
+
+func (s *syncer) eventsListen(ctx context.Context, queryCtx context.Context, conn *websocket.Conn) error {
+	defer conn.Close()
+
+	// Send regular pings
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(eventsPingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				// Let the server know we're going away, this unblocks the reader
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+				conn.Close()
+				return
+			case <-ticker.C:
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventsPingInterval))
 				if err != nil {
-					s.logger.Error("Failed to sync teams", log15.Ctx{"error": err})
-					continue
+					s.logger.Debug("Failed to ping askgod", log15.Ctx{"error": err})
 				}
 			}
 		}
 	}()
 
-	return chError, nil
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			// Got disconnected
+			return err
+		}
+
+		s.eventsProcess(queryCtx, data)
+
+		// Processing may have run a long sync, during which pongs couldn't be read
+		err = conn.SetReadDeadline(time.Now().Add(eventsPongTimeout))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *syncer) eventsProcess(ctx context.Context, data []byte) {
+	event := api.Event{}
+	err := json.Unmarshal(data, &event)
+	if err != nil {
+		s.logger.Error("Bad askgod event", log15.Ctx{"error": err})
+		return
+	}
+
+	s.logger.Debug("Received askgod event", log15.Ctx{"type": event.Type})
+
+	if event.Type == "flags" {
+		// Got a flag submission event
+		entry := api.EventFlag{}
+		err = json.Unmarshal(event.Metadata, &entry)
+		if err != nil {
+			s.logger.Error("Bad askgod flag event", log15.Ctx{"error": err})
+			return
+		}
+
+		// We only care about valid flags
+		if entry.Type != "valid" {
+			return
+		}
+
+		// Update discourse
+		s.logger.Debug("Askgod triggered posts update")
+		err = s.syncPosts(ctx)
+		if err != nil {
+			s.logger.Error("Failed to sync teams", log15.Ctx{"error": err})
+			return
+		}
+	} else if event.Type == "timeline" {
+		// Got a timeline event
+		entry := api.EventTimeline{}
+		err = json.Unmarshal(event.Metadata, &entry)
+		if err != nil {
+			s.logger.Error("Bad askgod timeline event", log15.Ctx{"error": err})
+			return
+		}
+
+		// Score changes may require posts to be retracted
+		if entry.Type == "score-removed" || entry.Type == "score-updated" {
+			s.logger.Debug("Askgod triggered posts update", log15.Ctx{"type": entry.Type})
+			err = s.syncPosts(ctx)
+			if err != nil {
+				s.logger.Error("Failed to sync posts", log15.Ctx{"error": err})
+			}
+
+			return
+		}
+
+		// We only care about team events
+		if entry.Type != "team-added" && entry.Type != "team-removed" && entry.Type != "team-updated" {
+			return
+		}
+
+		// Update discourse
+		s.logger.Debug("Askgod triggered teams update", log15.Ctx{"type": entry.Type})
+		err = s.syncTeams(ctx)
+		if err != nil {
+			s.logger.Error("Failed to sync teams", log15.Ctx{"error": err})
+			return
+		}
+	}
 }
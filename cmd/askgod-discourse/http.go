@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Discourse user payloads are a few kB at most
+const webhookMaxSize = 1024 * 1024
+
+// setupHTTP starts the HTTP servers, requests and the work they trigger are
+// made under ctx.
+func (s *syncer) setupHTTP(ctx context.Context) (chan error, error) {
+	chError := make(chan error, 2)
+
+	// The public endpoints are optional
+	if s.config.ListenAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.HandleFunc("/healthz", s.httpHealth)
+		mux.HandleFunc("/readyz", s.httpReady)
+
+		if s.config.WebhookSecret != "" {
+			mux.HandleFunc("/webhooks/discourse", func(w http.ResponseWriter, r *http.Request) {
+				s.httpWebhook(ctx, w, r)
+			})
+		}
+
+		s.serveHTTP(ctx, s.config.ListenAddress, mux, chError)
+	}
+
+	// The admin API gets its own address, keeping it off the public one
+	if s.config.AdminToken != "" {
+		mux := http.NewServeMux()
+		s.setupAdmin(mux)
+
+		s.serveHTTP(ctx, s.config.AdminListenAddress, mux, chError)
+	}
+
+	return chError, nil
+}
+
+func (s *syncer) serveHTTP(ctx context.Context, address string, handler http.Handler, chError chan error) {
+	server := &http.Server{
+		Addr:        address,
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	s.httpServers = append(s.httpServers, server)
+
+	go func() {
+		s.logger.Info("Listening for HTTP requests", log15.Ctx{"address": address})
+		err := server.ListenAndServe()
+		if err == http.ErrServerClosed {
+			return
+		}
+
+		chError <- err
+	}()
+}
+
+func (s *syncer) httpWebhook(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The payload is read before being authenticated, keep it small
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, webhookMaxSize))
+	if err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	// Validate the signature
+	if !webhookSignatureValid(s.config.WebhookSecret, body, r.Header.Get("X-Discourse-Event-Signature")) {
+		s.logger.Warn("Rejected webhook with an invalid signature", log15.Ctx{"remote": r.RemoteAddr})
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	// We only care about new users
+	if r.Header.Get("X-Discourse-Event") != "user_created" {
+		return
+	}
+
+	payload := struct {
+		User discourseUser `json:"user"`
+	}{}
+
+	err = json.Unmarshal(body, &payload)
+	if err != nil || payload.User.ID == 0 {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	// Process the user outside of the request, polling picks up any failure
+	s.webhooks.Add(1)
+	go func(user discourseUser) {
+		defer s.webhooks.Done()
+
+		s.logger.Debug("Received new user webhook", log15.Ctx{"user": user.Username})
+
+		teams, err := s.askgodGetTeams(ctx)
+		if err != nil {
+			s.logger.Error("Failed to get teams", log15.Ctx{"error": err})
+			return
+		}
+
+		s.usersLock.Lock()
+		defer s.usersLock.Unlock()
+
+		err = s.discourseProcessUser(ctx, user.ID, teams)
+		if err != nil {
+			s.logger.Error("Failed to process new user", log15.Ctx{"user": user.Username, "error": err})
+		}
+	}(payload.User)
+}
+
+// GET /healthz
+func (s *syncer) httpHealth(w http.ResponseWriter, r *http.Request) {
+	s.healthLock.Lock()
+	connected := s.eventsConnected
+	lastTimer := s.lastTimer
+	s.healthLock.Unlock()
+
+	if !connected {
+		httpError(w, http.StatusServiceUnavailable, fmt.Errorf("Disconnected from askgod events"))
+		return
+	}
+
+	if time.Since(lastTimer) > s.config.HealthTimerThreshold {
+		httpError(w, http.StatusServiceUnavailable, fmt.Errorf("Timer loop last ran %v ago", time.Since(lastTimer).Round(time.Second)))
+		return
+	}
+
+	httpJSON(w, nil)
+}
+
+// GET /readyz
+func (s *syncer) httpReady(w http.ResponseWriter, r *http.Request) {
+	s.healthLock.Lock()
+	ready := s.ready
+	s.healthLock.Unlock()
+
+	if !ready {
+		httpError(w, http.StatusServiceUnavailable, fmt.Errorf("Initial sync not completed"))
+		return
+	}
+
+	httpJSON(w, nil)
+}
+
+// webhookSignatureValid checks a "sha256=<hex>" HMAC of the request body.
+func webhookSignatureValid(secret string, body []byte, signature string) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+func httpJSON(w http.ResponseWriter, data interface{}) {
+	if data == nil {
+		data = map[string]string{"status": "ok"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+func httpError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
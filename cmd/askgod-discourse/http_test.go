@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWebhookSignatureValid(t *testing.T) {
+	body := []byte(`{"user":{"id":1}}`)
+
+	// HMAC-SHA256 of the body with "secret" as the key
+	signature := "sha256=2894a765bb6b316a113c33e1ccdb5a3307d79d819e90d4f7a2cccc7d123fda62"
+
+	tests := []struct {
+		name      string
+		secret    string
+		signature string
+		valid     bool
+	}{
+		{"valid", "secret", signature, true},
+		{"wrong secret", "other", signature, false},
+		{"missing prefix", "secret", signature[len("sha256="):], false},
+		{"invalid hex", "secret", "sha256=zz", false},
+		{"empty", "secret", "", false},
+	}
+
+	for _, test := range tests {
+		if webhookSignatureValid(test.secret, body, test.signature) != test.valid {
+			t.Errorf("%s: expected %v", test.name, test.valid)
+		}
+	}
+}
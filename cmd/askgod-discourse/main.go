@@ -17,8 +17,23 @@ func main() {
 	app.EnableBashCompletion = true
 	app.Action = cmdDaemon
 	app.Usage = "Starts a daemon that processes events as they arrive"
+	app.Commands = []*cli.Command{
+		{
+			Name:      "plan",
+			Usage:     "Shows what a sync would change without touching discourse",
+			ArgsUsage: "<config>",
+			Action:    cmdPlan,
+		},
+		{
+			Name:      "validate",
+			Usage:     "Checks the posts directory for errors",
+			ArgsUsage: "<config>",
+			Action:    cmdValidate,
+		},
+	}
 	err := app.Run(os.Args)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "askgod_discourse_api_requests_total",
+		Help: "API requests sent to askgod and discourse.",
+	}, []string{"server", "method", "status"})
+
+	metricRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "askgod_discourse_api_request_duration_seconds",
+		Help:    "Duration of the API requests sent to askgod and discourse.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"server", "method"})
+
+	metricSyncDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "askgod_discourse_sync_duration_seconds",
+		Help:    "Duration of the team and post syncs.",
+		Buckets: []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"sync"})
+
+	metricLastSync = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "askgod_discourse_last_sync_timestamp_seconds",
+		Help: "Time of the last successful team and post syncs.",
+	}, []string{"sync"})
+
+	metricPostsPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "askgod_discourse_posts_published_total",
+		Help: "Posts published to team, by post name.",
+	}, []string{"post"})
+
+	metricUsers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "askgod_discourse_users_total",
+		Help: "Pending users processed, by outcome.",
+	}, []string{"result"})
+
+	metricReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "askgod_discourse_websocket_reconnects_total",
+		Help: "Reconnections to the askgod event websocket.",
+	})
+)
+
+// metricsObserveSync records the duration of a sync and when it last succeeded.
+func metricsObserveSync(name string, start time.Time, err error) {
+	metricSyncDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+
+	if err == nil {
+		metricLastSync.WithLabelValues(name).SetToCurrentTime()
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/inconshreveable/log15"
 )
@@ -14,9 +15,20 @@ type syncer struct {
 	httpAskgod    *http.Client
 	httpDiscourse *http.Client
 	db            *sql.DB
+	discourse     discourseWriter
+	httpServers   []*http.Server
+
+	// Users being processed following a webhook
+	webhooks sync.WaitGroup
 
 	postsLock sync.Mutex
 	teamsLock sync.Mutex
+	usersLock sync.Mutex
+
+	healthLock      sync.Mutex
+	ready           bool
+	eventsConnected bool
+	lastTimer       time.Time
 }
 
 func getSyncer(path string) (*syncer, error) {
@@ -48,6 +60,25 @@ func getSyncer(path string) (*syncer, error) {
 	}
 
 	s.httpDiscourse = client
+	s.discourse = &discourseAPI{s: &s}
 
 	return &s, nil
 }
+
+func (s *syncer) setReady() {
+	s.healthLock.Lock()
+	s.ready = true
+	s.healthLock.Unlock()
+}
+
+func (s *syncer) setEventsConnected(connected bool) {
+	s.healthLock.Lock()
+	s.eventsConnected = connected
+	s.healthLock.Unlock()
+}
+
+func (s *syncer) setLastTimer() {
+	s.healthLock.Lock()
+	s.lastTimer = time.Now()
+	s.healthLock.Unlock()
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -9,23 +12,30 @@ import (
 	"strings"
 	"time"
 
+	"github.com/inconshreveable/log15"
 	"github.com/nsec/askgod/api"
 	"gopkg.in/yaml.v2"
 )
 
-func (s *syncer) syncTeams() error {
+func (s *syncer) syncTeams(ctx context.Context) (err error) {
 	s.teamsLock.Lock()
 	defer s.teamsLock.Unlock()
 
+	defer func(start time.Time) { metricsObserveSync("teams", start, err) }(time.Now())
+
 	// Get all teams from askgod
-	askgodTeams, err := s.askgodGetTeams()
+	askgodTeams, err := s.askgodGetTeams(ctx)
 	if err != nil {
 		return err
 	}
 
-	// Make a map based on askgod team id
+	// Make a map based on askgod team id, skipping teams without a tag
 	askgodTeamsMap := map[int64]api.AdminTeam{}
 	for _, entry := range askgodTeams {
+		if entry.Tags["discourse"] == "" {
+			continue
+		}
+
 		askgodTeamsMap[entry.ID] = entry
 	}
 
@@ -53,7 +63,7 @@ func (s *syncer) syncTeams() error {
 			}
 
 			// Create the team
-			err := s.discourseCreateTeam(discourseName, entry.ID, entry.Name)
+			err := s.discourseCreateTeam(ctx, discourseName, entry.ID, entry.Name, s.teamAppearance(entry.Tags))
 			if err != nil {
 				return err
 			}
@@ -61,37 +71,154 @@ func (s *syncer) syncTeams() error {
 			continue
 		}
 
+		// Removed tags are handled as removed teams
+		if entry.Tags["discourse"] == "" {
+			continue
+		}
+
+		// Bring back an archived team
+		if dbEntry.Archived {
+			err := s.discourseRestoreTeam(ctx, dbEntry)
+			if err != nil {
+				return err
+			}
+
+			dbEntry.Archived = false
+		}
+
+		// Resume an interrupted setup
+		if !dbEntry.provisioned() {
+			dbEntry, err = s.discourseProvisionTeam(ctx, dbEntry, true)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Changed tag
+		if entry.Tags["discourse"] != dbEntry.DiscourseName {
+			err := s.discourseRetagTeam(ctx, dbEntry, entry.Tags["discourse"])
+			if err != nil {
+				return err
+			}
+
+			dbEntry.DiscourseName = entry.Tags["discourse"]
+		}
+
 		// Existing team
 		if entry.Name != dbEntry.AskgodName {
 			// Rename the team
-			err := s.discourseRenameTeam(dbEntry.DiscourseName, dbEntry.DiscourseGroupID, entry.Name)
+			err := s.discourseRenameTeam(ctx, dbEntry, entry.Name)
+			if err != nil {
+				return err
+			}
+
+			dbEntry.AskgodName = entry.Name
+		}
+
+		// Changed appearance
+		appearance := s.teamAppearance(entry.Tags)
+		if appearance != s.appearanceOrDefault(dbEntry.appearance()) {
+			err := s.discourseRestyleTeam(ctx, dbEntry, appearance)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
-	// Delete removed teams
+	// Find removed teams
+	removedTeams := []dbTeam{}
 	for _, entry := range dbTeams {
 		_, ok := askgodTeamsMap[entry.AskgodID]
+		if ok || entry.Archived {
+			continue
+		}
 
-		if !ok {
-			// Delete the team
-			err := s.discourseDeleteTeam(entry.DiscourseName, entry.DiscourseGroupID, entry.DiscourseCategoryID)
+		removedTeams = append(removedTeams, entry)
+	}
+
+	if len(removedTeams) == 0 || s.config.TeamRemoval == "ignore" {
+		return nil
+	}
+
+	// Protect against empty and partial answers from askgod
+	if len(askgodTeamsMap) == 0 {
+		s.logger.Error("Refusing to remove teams, askgod returned none", log15.Ctx{"count": len(removedTeams)})
+		return nil
+	}
+
+	if s.config.TeamRemovalLimit > 0 && len(removedTeams) > s.config.TeamRemovalLimit {
+		s.logger.Error("Refusing to remove teams, too many are missing from askgod", log15.Ctx{"count": len(removedTeams), "limit": s.config.TeamRemovalLimit})
+		return nil
+	}
+
+	// Remove the teams
+	for _, entry := range removedTeams {
+		if s.config.TeamRemoval == "archive" && entry.provisioned() {
+			// Archive the team
+			err := s.discourseArchiveTeam(ctx, entry)
 			if err != nil {
 				return err
 			}
+
+			continue
+		}
+
+		// Delete the team
+		err := s.discourseDeleteTeam(ctx, entry.DiscourseName, entry.DiscourseGroupID, entry.DiscourseCategoryID)
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// teamAppearance is the look and location of a team's category.
+type teamAppearance struct {
+	Color     string
+	TextColor string
+	Parent    string
+}
+
+// teamAppearance applies the askgod team tags on top of the configured defaults.
+func (s *syncer) teamAppearance(tags map[string]string) teamAppearance {
+	appearance := teamAppearance{
+		Color:     s.config.CategoryColor,
+		TextColor: s.config.CategoryTextColor,
+		Parent:    s.config.CategoryParent,
+	}
+
+	if tags["discourse_color"] != "" {
+		appearance.Color = tags["discourse_color"]
+	}
+
+	if tags["discourse_text_color"] != "" {
+		appearance.TextColor = tags["discourse_text_color"]
+	}
+
+	if tags["discourse_parent"] != "" {
+		appearance.Parent = tags["discourse_parent"]
+	}
+
+	return appearance
+}
+
+// appearanceOrDefault fills in the defaults for teams predating per-team appearance.
+func (s *syncer) appearanceOrDefault(appearance teamAppearance) teamAppearance {
+	if appearance == (teamAppearance{}) {
+		return s.teamAppearance(nil)
+	}
+
+	return appearance
+}
+
 type post struct {
 	Type      string                      `yaml:"type"`
 	Topic     string                      `yaml:"topic"`
 	Trigger   *postTrigger                `yaml:"trigger"`
 	Title     string                      `yaml:"title"`
+	Category  int64                       `yaml:"category"`
+	Retract   bool                        `yaml:"retract"`
 	API       *postAPI                    `yaml:"api"`
 	Body      string                      `yaml:"body"`
 	Variables map[string]map[int64]string `yaml:"variables"`
@@ -101,33 +228,188 @@ type post struct {
 	} `yaml:"posts"`
 }
 
-type postTrigger struct {
-	Type      string `yaml:"type"`
-	Tag       string `yaml:"tag"`
-	Value     int64  `yaml:"value"`
-	After     string `yaml:"after"`
-	AfterTime time.Time
-}
+// templateVariable matches the %{name} variables in post bodies
+var templateVariable = regexp.MustCompile(`%\{(\w+)\}`)
+
+// builtinVariables are provided for every team
+var builtinVariables = []string{"team_name", "team_score", "team_rank"}
 
 type postAPI struct {
 	User string `yaml:"user"`
 	Key  string `yaml:"key"`
 }
 
-func (s *syncer) syncPosts() error {
+// syncIntents resolves the interrupted publications, returning those which
+// couldn't be checked and so mustn't be published again yet.
+func (s *syncer) syncIntents(ctx context.Context) (map[int64]map[string]bool, error) {
+	unresolved := map[int64]map[string]bool{}
+
+	intents, err := s.dbGetIntents()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, intent := range intents {
+		// Look for what may have been published
+		id, err := s.discourseFindIntent(ctx, intent)
+		if err != nil && !isNotFound(err) {
+			s.logger.Error("Failed to look for interrupted post", log15.Ctx{"team": intent.AskgodID, "name": intent.Name, "error": err})
+
+			if unresolved[intent.AskgodID] == nil {
+				unresolved[intent.AskgodID] = map[string]bool{}
+			}
+			unresolved[intent.AskgodID][intent.Name] = true
+			continue
+		}
+
+		// The target went away along with anything posted to it
+		if err != nil {
+			id = -1
+		}
+
+		if id == -1 {
+			// Never made it to discourse, it'll be published again
+			err = s.dbDeleteIntent(intent.ID)
+			if err != nil {
+				return nil, err
+			}
+
+			s.logger.Info("Dropped unpublished post", log15.Ctx{"team": intent.AskgodID, "name": intent.Name})
+			continue
+		}
+
+		// Adopt the existing post
+		err = s.dbCompleteIntent(intent.ID, intent.AskgodID, intent.Name, id, intent.ContentHash)
+		if err != nil {
+			return nil, err
+		}
+
+		s.logger.Info("Adopted existing post", log15.Ctx{"team": intent.AskgodID, "name": intent.Name, "id": id})
+	}
+
+	return unresolved, nil
+}
+
+func parsePost(path string, strict bool) (*post, error) {
+	// Read the file
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the content
+	newPost := post{}
+	if strict {
+		err = yaml.UnmarshalStrict(content, &newPost)
+	} else {
+		err = yaml.Unmarshal(content, &newPost)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse '%s': %v", path, err)
+	}
+
+	// Validate the trigger and convert timestamps
+	if newPost.Trigger != nil {
+		err = newPost.Trigger.parse()
+		if err != nil {
+			return nil, fmt.Errorf("Bad trigger in '%s': %v", path, err)
+		}
+	}
+
+	return &newPost, nil
+}
+
+// validate checks the post against the other posts, the askgod team IDs
+// and the askgod flag tags.
+func (p *post) validate(posts map[string]post, teamIDs []int64, flags map[string]map[int64]time.Time) []error {
+	errs := []error{}
+
+	// Check the type specific fields
+	if p.Type == "topic" {
+		if p.Title == "" {
+			errs = append(errs, fmt.Errorf("Topic requires a 'title'"))
+		}
+
+		if p.Topic != "" {
+			errs = append(errs, fmt.Errorf("Topic can't have a 'topic'"))
+		}
+	} else if p.Type == "post" || p.Type == "posts" {
+		if p.Topic == "" {
+			errs = append(errs, fmt.Errorf("Post requires a 'topic'"))
+		} else {
+			topic, ok := posts[p.Topic]
+			if !ok {
+				errs = append(errs, fmt.Errorf("Unknown topic '%s'", p.Topic))
+			} else if topic.Type != "topic" {
+				errs = append(errs, fmt.Errorf("Post '%s' isn't a topic", p.Topic))
+			}
+		}
+
+		if p.Category != 0 {
+			errs = append(errs, fmt.Errorf("Only topics can have a 'category'"))
+		}
+
+		if p.Type == "posts" && len(p.Posts) == 0 {
+			errs = append(errs, fmt.Errorf("Posts requires a list of 'posts'"))
+		}
+	} else {
+		errs = append(errs, fmt.Errorf("Invalid type: %s", p.Type))
+	}
+
+	// Check the trigger
+	if p.Trigger != nil {
+		errs = append(errs, p.Trigger.validate(posts, flags)...)
+	}
+
+	// Check the variables
+	for _, match := range templateVariable.FindAllStringSubmatch(p.Body, -1) {
+		name := match[1]
+		if stringInSlice(name, builtinVariables) {
+			continue
+		}
+
+		values, ok := p.Variables[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("Undefined variable: %s", name))
+			continue
+		}
+
+		missing := []string{}
+		for _, id := range teamIDs {
+			_, ok := values[id]
+			if !ok {
+				missing = append(missing, fmt.Sprintf("%d", id))
+			}
+		}
+
+		if len(missing) > 0 {
+			errs = append(errs, fmt.Errorf("Variable '%s' missing for teams: %s", name, strings.Join(missing, ", ")))
+		}
+	}
+
+	return errs
+}
+
+func (s *syncer) syncPosts(ctx context.Context) (err error) {
 	s.postsLock.Lock()
 	defer s.postsLock.Unlock()
 
-	posts := map[string]post{}
+	defer func(start time.Time) { metricsObserveSync("posts", start, err) }(time.Now())
+
+	// Recover from interrupted publications
+	unresolvedIntents, err := s.syncIntents(ctx)
+	if err != nil {
+		return err
+	}
 
 	// Get the submitted flags
-	askgodFlags, err := s.askgodGetTeamDiscourseFlags()
+	askgodFlags, err := s.askgodGetTeamDiscourseFlags(ctx)
 	if err != nil {
 		return err
 	}
 
 	// Get the current scores
-	askgodScores, err := s.askgodGetTeamScores()
+	askgodScores, askgodRanks, err := s.askgodGetTeamScores(ctx)
 	if err != nil {
 		return err
 	}
@@ -138,55 +420,65 @@ func (s *syncer) syncPosts() error {
 		return err
 	}
 
-	// Get all the teams from the database
-	dbTeams, err := s.dbGetTeams()
+	// Get the publication time of the posts
+	dbTeamPostTimes, err := s.dbGetTeamPostTimes()
 	if err != nil {
 		return err
 	}
 
-	// Enumerate the posts directory
-	files, err := ioutil.ReadDir(s.config.Posts)
+	// Get the content hash of the posts
+	dbTeamPostHashes, err := s.dbGetTeamPostHashes()
 	if err != nil {
 		return err
 	}
 
-	// Parse the individual yaml files
-	for _, file := range files {
-		if !strings.HasSuffix(file.Name(), ".yaml") {
-			continue
-		}
+	// Get the posts retracted by hand
+	dbRetractions, err := s.dbGetRetractions()
+	if err != nil {
+		return err
+	}
 
-		// Get the full path
-		path := filepath.Join(s.config.Posts, file.Name())
+	// Get the posts published by hand
+	dbOverrides, err := s.dbGetOverrides()
+	if err != nil {
+		return err
+	}
 
-		// Read the file
-		content, err := ioutil.ReadFile(path)
-		if err != nil {
-			return err
-		}
+	// Get all the teams from the database
+	allTeams, err := s.dbGetTeams()
+	if err != nil {
+		return err
+	}
 
-		// Parse the content
-		newPost := post{}
-		err = yaml.Unmarshal(content, &newPost)
-		if err != nil {
-			return fmt.Errorf("Failed to parse '%s': %v", path, err)
+	// Skip the teams which aren't fully setup yet or archived
+	dbTeams := []dbTeam{}
+	for _, team := range allTeams {
+		if !team.provisioned() || team.Archived {
+			continue
 		}
 
-		// Convert timestamps
-		if newPost.Trigger != nil {
-			if newPost.Trigger.After != "" {
-				ts, err := time.ParseInLocation("2006/01/02 15:04", newPost.Trigger.After, time.Local)
-				if err != nil {
-					return err
-				}
+		dbTeams = append(dbTeams, team)
+	}
 
-				newPost.Trigger.AfterTime = ts
-			}
-		}
+	// Record the rank changes and get their history
+	dbRankHistory, err := s.syncRanks(askgodRanks)
+	if err != nil {
+		return err
+	}
 
-		// Add the post to the map
-		name := strings.TrimSuffix(file.Name(), ".yaml")
-		posts[name] = newPost
+	// Data needed to evaluate the triggers
+	state := triggerState{
+		flags:       askgodFlags,
+		scores:      askgodScores,
+		ranks:       askgodRanks,
+		rankHistory: dbRankHistory,
+		postTimes:   dbTeamPostTimes,
+	}
+
+	// Load all the posts
+	posts, err := s.loadPosts()
+	if err != nil {
+		return err
 	}
 
 	// Processing of post entries
@@ -207,40 +499,43 @@ func (s *syncer) syncPosts() error {
 				continue
 			}
 
+			// Update what was already published
+			for _, team := range dbTeams {
+				postIDs, ok := dbTeamPosts[team.AskgodID][name]
+				if !ok {
+					continue
+				}
+
+				// Retract it if the trigger no longer matches, unless an admin published it
+				if post.Retract && post.Trigger != nil && !dbOverrides[team.AskgodID][name] && !post.Trigger.match(team, &state) {
+					err := s.retractEntry(ctx, team, name, post, postIDs, posts)
+					if err != nil {
+						return err
+					}
+
+					continue
+				}
+
+				if team.AskgodName == "" {
+					team.AskgodName = team.DiscourseName
+				}
+
+				body, staticBody := post.renderBody(post.Body, team, &state)
+				err := s.updateEntry(ctx, team, name, post, apiUser, apiKey, postIDs, dbTeamPosts[team.AskgodID][post.Topic], dbTeamPostHashes[team.AskgodID][name], body, staticBody)
+				if err != nil {
+					return err
+				}
+			}
+
 			// Validate the trigger
 			if post.Trigger != nil {
-				if post.Trigger.Type == "timer" {
-					if post.Trigger.AfterTime.Unix() > time.Now().Unix() {
-						// Not time yet
+				for _, team := range dbTeams {
+					if !post.Trigger.match(team, &state) {
+						// Not triggered for this team yet
 						continue
 					}
 
-					// If it's time, send to everyone
-					teams = dbTeams
-				} else if post.Trigger.Type == "flag" {
-					for _, team := range dbTeams {
-						if post.Trigger.Tag == "" {
-							if askgodScores[team.AskgodID] == 0 {
-								// Hasn't sent a flag yet
-								continue
-							}
-						} else {
-							if !int64InSlice(team.AskgodID, askgodFlags[post.Trigger.Tag]) {
-								// Not scored that yet
-								continue
-							}
-						}
-						teams = append(teams, team)
-					}
-				} else if post.Trigger.Type == "score" {
-					for _, team := range dbTeams {
-						if askgodScores[team.AskgodID] < post.Trigger.Value {
-							// Not there yet
-							continue
-						}
-
-						teams = append(teams, team)
-					}
+					teams = append(teams, team)
 				}
 			} else {
 				// Everyone is getting the post
@@ -259,53 +554,19 @@ func (s *syncer) syncPosts() error {
 					continue
 				}
 
-				// Apply templating
-				if team.AskgodName == "" {
-					team.AskgodName = team.DiscourseName
+				if dbRetractions[team.AskgodID][name] {
+					// Retracted by an admin, skip
+					continue
 				}
 
-				body := post.Body
-				body = strings.Replace(body, "%{team_name}", team.AskgodName, -1)
-				body = strings.Replace(body, "%{team_score}", fmt.Sprintf("%d", askgodScores[team.AskgodID]), -1)
-
-				// Process template variables
-				r := regexp.MustCompile(`%\{(\w+)\}`)
-				body = r.ReplaceAllStringFunc(body, func(p string) string {
-					return post.Variables[p[2:len(p)-1]][team.AskgodID]
-				})
+				if unresolvedIntents[team.AskgodID][name] {
+					// May already be on discourse, skip until we know
+					continue
+				}
 
-				if post.Type == "topic" {
-					err := s.discourseCreateTopic(team.DiscourseName, team.AskgodID, apiUser, apiKey, name, team.DiscourseCategoryID, post.Title, body)
-					if err != nil {
-						return err
-					}
-				} else if post.Type == "post" {
-					postIDs := dbTeamPosts[team.AskgodID][post.Topic]
-					for _, id := range postIDs {
-						err := s.discourseCreatePost(team.DiscourseName, team.AskgodID, apiUser, apiKey, name, id, body)
-						if err != nil {
-							return err
-						}
-					}
-				} else if post.Type == "posts" {
-					postIDs := dbTeamPosts[team.AskgodID][post.Topic]
-					for _, subPost := range post.Posts {
-						subApiUser := apiUser
-						subApiKey := apiKey
-						if subPost.API != nil {
-							subApiUser = subPost.API.User
-							subApiKey = subPost.API.Key
-						}
-
-						for _, id := range postIDs {
-							err := s.discourseCreatePost(team.DiscourseName, team.AskgodID, subApiUser, subApiKey, name, id, subPost.Body)
-							if err != nil {
-								return err
-							}
-						}
-					}
-				} else {
-					return fmt.Errorf("Invalid type: %s", post.Type)
+				err := s.publishEntry(ctx, team, name, post, apiUser, apiKey, dbTeamPosts[team.AskgodID][post.Topic], &state)
+				if err != nil {
+					return err
 				}
 			}
 		}
@@ -325,7 +586,7 @@ func (s *syncer) syncPosts() error {
 			_, err := os.Lstat(filepath.Join(s.config.Posts, fmt.Sprintf("%s.yaml", name)))
 			if err != nil && os.IsNotExist(err) {
 				for _, postid := range postids {
-					err = s.discourseDeleteTopic(postid)
+					err = s.discourse.deleteTopic(ctx, postid)
 					if err != nil {
 						return err
 					}
@@ -345,6 +606,16 @@ func (s *syncer) syncPosts() error {
 		return err
 	}
 
+	state.postTimes, err = s.dbGetTeamPostTimes()
+	if err != nil {
+		return err
+	}
+
+	dbTeamPostHashes, err = s.dbGetTeamPostHashes()
+	if err != nil {
+		return err
+	}
+
 	// Then the posts
 	err = processEntry("post")
 	if err != nil {
@@ -359,3 +630,272 @@ func (s *syncer) syncPosts() error {
 
 	return nil
 }
+
+// syncRanks records the teams whose rank changed since the last sync and
+// returns the resulting rank history.
+func (s *syncer) syncRanks(askgodRanks map[int64]int64) (map[int64][]rankRecord, error) {
+	dbRankHistory, err := s.dbGetRankHistory()
+	if err != nil {
+		return nil, err
+	}
+
+	// Teams which left the scoreboard become unranked
+	changes := map[int64]int64{}
+	for teamID, history := range dbRankHistory {
+		_, ok := askgodRanks[teamID]
+		if !ok && history[len(history)-1].Rank != 0 {
+			changes[teamID] = 0
+		}
+	}
+
+	for teamID, rank := range askgodRanks {
+		history := dbRankHistory[teamID]
+		if len(history) == 0 || history[len(history)-1].Rank != rank {
+			changes[teamID] = rank
+		}
+	}
+
+	if len(changes) == 0 {
+		return dbRankHistory, nil
+	}
+
+	err = s.dbCreateRanks(changes, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return s.dbGetRankHistory()
+}
+
+// loadPosts parses all the posts from the posts directory.
+func (s *syncer) loadPosts() (map[string]post, error) {
+	posts := map[string]post{}
+
+	// Enumerate the posts directory
+	files, err := ioutil.ReadDir(s.config.Posts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the individual yaml files
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".yaml") {
+			continue
+		}
+
+		// Get the full path
+		path := filepath.Join(s.config.Posts, file.Name())
+
+		// Parse the file
+		newPost, err := parsePost(path, false)
+		if err != nil {
+			return nil, err
+		}
+
+		// Add the post to the map
+		name := strings.TrimSuffix(file.Name(), ".yaml")
+		posts[name] = *newPost
+	}
+
+	return posts, nil
+}
+
+func (s *syncer) publishEntry(ctx context.Context, team dbTeam, name string, post post, apiUser string, apiKey string, topicIDs []int64, state *triggerState) error {
+	// Apply templating
+	if team.AskgodName == "" {
+		team.AskgodName = team.DiscourseName
+	}
+
+	body, staticBody := post.renderBody(post.Body, team, state)
+
+	if post.Type == "topic" {
+		// Default to the team's own category
+		category := team.DiscourseCategoryID
+		if post.Category != 0 {
+			category = post.Category
+		}
+
+		err := s.discourseCreateTopic(ctx, team.DiscourseName, team.AskgodID, apiUser, apiKey, name, category, post.Title, body, postHash(post.Title, staticBody))
+		if err != nil {
+			return err
+		}
+
+		metricPostsPublished.WithLabelValues(name).Inc()
+	} else if post.Type == "post" {
+		for _, id := range topicIDs {
+			err := s.discourseCreatePost(ctx, team.DiscourseName, team.AskgodID, apiUser, apiKey, name, id, body, postHash("", staticBody))
+			if err != nil {
+				return err
+			}
+
+			metricPostsPublished.WithLabelValues(name).Inc()
+		}
+	} else if post.Type == "posts" {
+		for _, subPost := range post.Posts {
+			subApiUser := apiUser
+			subApiKey := apiKey
+			if subPost.API != nil {
+				subApiUser = subPost.API.User
+				subApiKey = subPost.API.Key
+			}
+
+			for _, id := range topicIDs {
+				err := s.discourseCreatePost(ctx, team.DiscourseName, team.AskgodID, subApiUser, subApiKey, name, id, subPost.Body, postHash("", subPost.Body))
+				if err != nil {
+					return err
+				}
+
+				metricPostsPublished.WithLabelValues(name).Inc()
+			}
+		}
+	} else {
+		return fmt.Errorf("Invalid type: %s", post.Type)
+	}
+
+	return nil
+}
+
+// renderBody applies the templating to a post body. Alongside the rendered
+// body, it returns a version with the score and rank left untouched so
+// that score changes alone don't cause published posts to be edited.
+func (p *post) renderBody(body string, team dbTeam, state *triggerState) (string, string) {
+	body = strings.Replace(body, "%{team_name}", team.AskgodName, -1)
+
+	// Process template variables
+	body = templateVariable.ReplaceAllStringFunc(body, func(v string) string {
+		if v == "%{team_score}" || v == "%{team_rank}" {
+			return v
+		}
+
+		return p.Variables[v[2:len(v)-1]][team.AskgodID]
+	})
+
+	staticBody := body
+
+	body = strings.Replace(body, "%{team_score}", fmt.Sprintf("%d", state.scores[team.AskgodID]), -1)
+	// Teams missing from the scoreboard don't have a rank
+	rank := "-"
+	if value, ok := state.ranks[team.AskgodID]; ok {
+		rank = fmt.Sprintf("%d", value)
+	}
+
+	body = strings.Replace(body, "%{team_rank}", rank, -1)
+
+	return body, staticBody
+}
+
+func postHash(title string, body string) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s", title, body)))
+	return hex.EncodeToString(hash[:])
+}
+
+func (s *syncer) updateEntry(ctx context.Context, team dbTeam, name string, post post, apiUser string, apiKey string, postIDs []int64, topicIDs []int64, hashes map[int64]string, body string, staticBody string) error {
+	if post.Type == "topic" || post.Type == "post" {
+		title := ""
+		if post.Type == "topic" {
+			title = post.Title
+		}
+
+		hash := postHash(title, staticBody)
+		for _, id := range postIDs {
+			if hashes[id] == hash {
+				continue
+			}
+
+			// Entries predating content tracking are adopted as-is
+			if hashes[id] != "" {
+				var err error
+				if post.Type == "topic" {
+					err = s.discourseUpdateTopic(ctx, team.DiscourseName, apiUser, apiKey, name, id, title, body)
+				} else {
+					err = s.discourseUpdatePost(ctx, team.DiscourseName, apiUser, apiKey, name, id, body)
+				}
+
+				if err != nil {
+					return err
+				}
+			}
+
+			err := s.dbUpdatePostHash(name, id, hash)
+			if err != nil {
+				return err
+			}
+		}
+	} else if post.Type == "posts" {
+		// Entries were created in order, once per topic for each sub-post
+		if len(topicIDs) == 0 || len(postIDs) != len(post.Posts)*len(topicIDs) {
+			s.logger.Warn("Can't update posts, the number of entries changed", log15.Ctx{"team": team.DiscourseName, "name": name})
+			return nil
+		}
+
+		for i, id := range postIDs {
+			subPost := post.Posts[i/len(topicIDs)]
+
+			hash := postHash("", subPost.Body)
+			if hashes[id] == hash {
+				continue
+			}
+
+			if hashes[id] != "" {
+				subApiUser := apiUser
+				subApiKey := apiKey
+				if subPost.API != nil {
+					subApiUser = subPost.API.User
+					subApiKey = subPost.API.Key
+				}
+
+				err := s.discourseUpdatePost(ctx, team.DiscourseName, subApiUser, subApiKey, name, id, subPost.Body)
+				if err != nil {
+					return err
+				}
+			}
+
+			err := s.dbUpdatePostHash(name, id, hash)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *syncer) retractEntry(ctx context.Context, team dbTeam, name string, post post, postIDs []int64, posts map[string]post) error {
+	// Delete from discourse
+	for _, id := range postIDs {
+		var err error
+		if post.Type == "topic" {
+			err = s.discourse.deleteTopic(ctx, id)
+		} else {
+			err = s.discourse.deletePost(ctx, id)
+		}
+
+		if err != nil {
+			s.logger.Error("Failed to retract post", log15.Ctx{"err": err, "team": team.DiscourseName, "name": name, "id": id})
+			return err
+		}
+	}
+
+	// Delete the DB entries
+	err := s.dbDeleteTeamPost(team.AskgodID, name)
+	if err != nil {
+		return err
+	}
+
+	// Replies went away along with the topic
+	if post.Type == "topic" {
+		for replyName, reply := range posts {
+			if reply.Topic != name {
+				continue
+			}
+
+			err := s.dbDeleteTeamPost(team.AskgodID, replyName)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	s.logger.Info("Retracted post", log15.Ctx{"team": team.DiscourseName, "name": name})
+	return nil
+}
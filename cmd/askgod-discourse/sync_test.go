@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inconshreveable/log15"
+)
+
+// fakeDiscourse answers GET requests with the JSON body registered for their
+// path and query, "error" being turned into a server error.
+type fakeDiscourse map[string]string
+
+func (f fakeDiscourse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, ok := f[r.URL.RequestURI()]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if body == "error" {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte(body))
+}
+
+func newTestSyncer(t *testing.T, discourse fakeDiscourse) *syncer {
+	t.Helper()
+
+	server := httptest.NewServer(discourse)
+	t.Cleanup(server.Close)
+
+	s := &syncer{
+		config: &config{
+			Database:       filepath.Join(t.TempDir(), "test.db"),
+			DiscourseURL:   server.URL,
+			DiscourseRetry: retryConfig{Attempts: 1},
+		},
+		logger:        log15.New(),
+		httpDiscourse: server.Client(),
+	}
+
+	s.logger.SetHandler(log15.DiscardHandler())
+	s.discourse = &discourseAPI{s: s}
+
+	err := s.dbSetup()
+	if err != nil {
+		t.Fatalf("Failed to setup the database: %v", err)
+	}
+	t.Cleanup(func() { s.db.Close() })
+
+	err = s.dbCreateTeam(1, "Team One", "team01", 10, 20, teamAppearance{})
+	if err != nil {
+		t.Fatalf("Failed to create team: %v", err)
+	}
+
+	return s
+}
+
+func topicList(more bool, topics ...string) string {
+	moreURL := ""
+	if more {
+		moreURL = "/c/30/l/latest.json?page=1"
+	}
+
+	return fmt.Sprintf(`{"topic_list":{"more_topics_url":%q,"topics":[%s]}}`, moreURL, strings.Join(topics, ","))
+}
+
+func TestSyncIntents(t *testing.T) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	old := time.Now().Add(-24 * time.Hour).UTC().Format(time.RFC3339)
+	marker := fmt.Sprintf("Body%s", intentMarker(1))
+
+	tests := []struct {
+		name       string
+		intentType string
+		target     int64
+		discourse  fakeDiscourse
+		adopted    int64
+		unresolved bool
+	}{
+		{
+			name:       "topic with a rewritten title on a later page",
+			intentType: "topic",
+			target:     30,
+			discourse: fakeDiscourse{
+				"/c/30.json?page=0": topicList(true, fmt.Sprintf(`{"id":4,"title":"Old","created_at":%q}`, old), fmt.Sprintf(`{"id":5,"title":"Other","created_at":%q}`, now)),
+				"/c/30.json?page=1": topicList(false, fmt.Sprintf(`{"id":6,"title":"New Challenge!","created_at":%q}`, now)),
+				"/t/5.json":         `{"post_stream":{"posts":[{"id":50}]}}`,
+				"/posts/50.json":    `{"id":50,"raw":"Other"}`,
+				"/t/6.json":         `{"post_stream":{"posts":[{"id":60}]}}`,
+				"/posts/60.json":    fmt.Sprintf(`{"id":60,"raw":%q}`, marker),
+			},
+			adopted: 6,
+		},
+		{
+			name:       "topic never published",
+			intentType: "topic",
+			target:     30,
+			discourse: fakeDiscourse{
+				"/c/30.json?page=0": topicList(false, fmt.Sprintf(`{"id":5,"title":"Other","created_at":%q}`, now)),
+				"/t/5.json":         `{"post_stream":{"posts":[{"id":50}]}}`,
+				"/posts/50.json":    `{"id":50,"raw":"Other"}`,
+			},
+		},
+		{
+			name:       "category deleted",
+			intentType: "topic",
+			target:     30,
+			discourse:  fakeDiscourse{},
+		},
+		{
+			name:       "category lookup failure",
+			intentType: "topic",
+			target:     30,
+			discourse: fakeDiscourse{
+				"/c/30.json?page=0": "error",
+			},
+			unresolved: true,
+		},
+		{
+			name:       "reply followed by others",
+			intentType: "post",
+			target:     40,
+			discourse: fakeDiscourse{
+				"/t/40.json":     `{"post_stream":{"stream":[70,71,72]}}`,
+				"/posts/71.json": fmt.Sprintf(`{"id":71,"raw":%q,"created_at":%q}`, marker, now),
+				"/posts/72.json": fmt.Sprintf(`{"id":72,"raw":"Later reply","created_at":%q}`, now),
+			},
+			adopted: 71,
+		},
+		{
+			name:       "reply never published",
+			intentType: "post",
+			target:     40,
+			discourse: fakeDiscourse{
+				"/t/40.json":     `{"post_stream":{"stream":[70,72]}}`,
+				"/posts/72.json": fmt.Sprintf(`{"id":72,"raw":"Later reply","created_at":%q}`, now),
+			},
+		},
+		{
+			name:       "topic lookup failure",
+			intentType: "post",
+			target:     40,
+			discourse: fakeDiscourse{
+				"/t/40.json": "error",
+			},
+			unresolved: true,
+		},
+	}
+
+	for _, test := range tests {
+		s := newTestSyncer(t, test.discourse)
+
+		_, err := s.dbCreateIntent(1, "example", test.intentType, test.target, "New challenge!", "hash")
+		if err != nil {
+			t.Fatalf("%s: failed to create intent: %v", test.name, err)
+		}
+
+		unresolved, err := s.syncIntents(context.Background())
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		if unresolved[1]["example"] != test.unresolved {
+			t.Errorf("%s: expected unresolved to be %v", test.name, test.unresolved)
+		}
+
+		// Unresolved intents are kept for the next sync
+		intents, err := s.dbGetIntents()
+		if err != nil {
+			t.Fatalf("%s: failed to get intents: %v", test.name, err)
+		}
+
+		if test.unresolved != (len(intents) == 1) {
+			t.Errorf("%s: expected the intent to be kept only if unresolved, got %d intents", test.name, len(intents))
+		}
+
+		// Adopted posts are recorded
+		posts, err := s.dbGetTeamPosts()
+		if err != nil {
+			t.Fatalf("%s: failed to get posts: %v", test.name, err)
+		}
+
+		ids := posts[1]["example"]
+		if test.adopted == 0 && len(ids) != 0 {
+			t.Errorf("%s: expected nothing to be adopted, got %v", test.name, ids)
+		} else if test.adopted != 0 && (len(ids) != 1 || ids[0] != test.adopted) {
+			t.Errorf("%s: expected %d to be adopted, got %v", test.name, test.adopted, ids)
+		}
+	}
+}
+
+func TestSyncRanks(t *testing.T) {
+	s := newTestSyncer(t, fakeDiscourse{})
+
+	err := s.dbCreateTeam(2, "Team Two", "team02", 11, 21, teamAppearance{})
+	if err != nil {
+		t.Fatalf("Failed to create team: %v", err)
+	}
+
+	// Team 3 isn't on discourse, team 2 leaves the scoreboard
+	syncs := []map[int64]int64{
+		{1: 2, 2: 1, 3: 3},
+		{1: 2, 2: 1, 3: 3},
+		{1: 1, 2: 2, 3: 3},
+		{1: 1, 3: 3},
+	}
+
+	var history map[int64][]rankRecord
+	for _, ranks := range syncs {
+		history, err = s.syncRanks(ranks)
+		if err != nil {
+			t.Fatalf("Failed to sync ranks: %v", err)
+		}
+	}
+
+	expected := map[int64][]int64{1: {2, 1}, 2: {1, 2, 0}}
+	if len(history) != len(expected) {
+		t.Fatalf("Expected history for %d teams, got %v", len(expected), history)
+	}
+
+	for teamID, ranks := range expected {
+		if len(history[teamID]) != len(ranks) {
+			t.Errorf("Expected %d records for team %d, got %v", len(ranks), teamID, history[teamID])
+			continue
+		}
+
+		for i, rank := range ranks {
+			if history[teamID][i].Rank != rank {
+				t.Errorf("Expected rank %d in record %d for team %d, got %d", rank, i, teamID, history[teamID][i].Rank)
+			}
+		}
+	}
+}
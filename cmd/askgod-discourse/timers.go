@@ -1,30 +1,53 @@
 package main
 
 import (
+	"context"
 	"time"
 
 	"github.com/inconshreveable/log15"
 )
 
-func (s *syncer) setupTimers() (chan error, error) {
+// setupTimers runs the periodic tasks until ctx is cancelled. The syncs run
+// under queryCtx so that a shutdown lets them complete.
+func (s *syncer) setupTimers(ctx context.Context, queryCtx context.Context) (chan error, error) {
 	chError := make(chan error, 1)
+	s.setLastTimer()
 
 	go func() {
+		lastReconcile := time.Now()
+
 		for {
-			time.Sleep(30 * time.Second)
+			select {
+			case <-time.After(30 * time.Second):
+			case <-ctx.Done():
+				return
+			}
+
+			s.setLastTimer()
 			s.logger.Debug("Processing timer based tasks")
 
 			// Process pending users
 			s.logger.Debug("Looking for pending users")
-			err := s.discourseProcessNewUsers()
+			err := s.discourseProcessNewUsers(queryCtx)
 			if err != nil {
 				s.logger.Error("Failed to process pending users", log15.Ctx{"error": err})
 				continue
 			}
 
+			// Check the team memberships
+			if s.config.MembershipReconcile != "disabled" && time.Since(lastReconcile) > s.config.MembershipReconcileInterval {
+				s.logger.Debug("Checking team memberships")
+				lastReconcile = time.Now()
+
+				err = s.discourseReconcileMembers(queryCtx)
+				if err != nil {
+					s.logger.Error("Failed to check team memberships", log15.Ctx{"error": err})
+				}
+			}
+
 			// Look for scheduled posts
 			s.logger.Debug("Looking for scheduled posts")
-			err = s.syncPosts()
+			err = s.syncPosts(queryCtx)
 			if err != nil {
 				s.logger.Error("Failed to process scheduled posts", log15.Ctx{"error": err})
 				continue
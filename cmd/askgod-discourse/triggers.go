@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type postTrigger struct {
+	Type      string    `yaml:"type"`
+	Tag       string    `yaml:"tag"`
+	Value     int64     `yaml:"value"`
+	After     string    `yaml:"after"`
+	AfterTime time.Time `yaml:"-"`
+
+	// Relative timers
+	Delay         string        `yaml:"delay"`
+	DelayDuration time.Duration `yaml:"-"`
+	Post          string        `yaml:"post"`
+
+	// Rank changes
+	Window         string        `yaml:"window"`
+	WindowDuration time.Duration `yaml:"-"`
+
+	// Composite triggers
+	All []*postTrigger `yaml:"all"`
+	Any []*postTrigger `yaml:"any"`
+	Not *postTrigger   `yaml:"not"`
+}
+
+// triggerState holds the askgod data needed to evaluate triggers.
+type triggerState struct {
+	flags       map[string]map[int64]time.Time
+	scores      map[int64]int64
+	ranks       map[int64]int64
+	rankHistory map[int64][]rankRecord
+	postTimes   map[int64]map[string]time.Time
+}
+
+// rankRecord is the rank of a team from a given time on, 0 being unranked.
+type rankRecord struct {
+	Rank int64
+	Time time.Time
+}
+
+// rankAt returns the rank a team had at the given time. If that predates
+// the history of the team, its earliest known rank is used.
+func (s *triggerState) rankAt(teamID int64, ts time.Time) (int64, bool) {
+	history := s.rankHistory[teamID]
+	if len(history) == 0 {
+		return 0, false
+	}
+
+	rank := history[0].Rank
+	for _, record := range history {
+		if record.Time.After(ts) {
+			break
+		}
+
+		rank = record.Rank
+	}
+
+	return rank, rank != 0
+}
+
+func (t *postTrigger) parse() error {
+	// Count the kind of triggers defined
+	kinds := 0
+	if t.Type != "" {
+		kinds++
+	}
+
+	if t.All != nil {
+		kinds++
+	}
+
+	if t.Any != nil {
+		kinds++
+	}
+
+	if t.Not != nil {
+		kinds++
+	}
+
+	if kinds != 1 {
+		return fmt.Errorf("Trigger must have exactly one of 'type', 'all', 'any' or 'not'")
+	}
+
+	// Convert timestamps
+	if t.After != "" {
+		ts, err := time.ParseInLocation("2006/01/02 15:04", t.After, time.Local)
+		if err != nil {
+			return err
+		}
+
+		t.AfterTime = ts
+	}
+
+	// Convert durations
+	if t.Delay != "" {
+		if t.Type != "timer" {
+			return fmt.Errorf("Only timer triggers can have a delay")
+		}
+
+		if (t.Tag == "") == (t.Post == "") {
+			return fmt.Errorf("Relative timers must have exactly one of 'tag' or 'post'")
+		}
+
+		duration, err := time.ParseDuration(t.Delay)
+		if err != nil {
+			return err
+		}
+
+		t.DelayDuration = duration
+	}
+
+	if t.Window != "" {
+		if t.Type != "rank_change" {
+			return fmt.Errorf("Only rank change triggers can have a window")
+		}
+
+		duration, err := time.ParseDuration(t.Window)
+		if err != nil {
+			return err
+		}
+
+		t.WindowDuration = duration
+	}
+
+	// Parse the nested triggers
+	children := append([]*postTrigger{}, t.All...)
+	children = append(children, t.Any...)
+	if t.Not != nil {
+		children = append(children, t.Not)
+	}
+
+	for _, child := range children {
+		if child == nil {
+			return fmt.Errorf("Empty nested trigger")
+		}
+
+		err := child.parse()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validate checks the trigger against the known posts and askgod flag tags.
+func (t *postTrigger) validate(posts map[string]post, flags map[string]map[int64]time.Time) []error {
+	errs := []error{}
+
+	// Composite triggers
+	children := append([]*postTrigger{}, t.All...)
+	children = append(children, t.Any...)
+	if t.Not != nil {
+		children = append(children, t.Not)
+	}
+
+	for _, child := range children {
+		errs = append(errs, child.validate(posts, flags)...)
+	}
+
+	if t.Type == "" {
+		return errs
+	}
+
+	// Flag references
+	checkTag := func() {
+		_, ok := flags[t.Tag]
+		if t.Tag != "" && !ok {
+			errs = append(errs, fmt.Errorf("Unknown flag tag '%s' in %s trigger", t.Tag, t.Type))
+		}
+	}
+
+	if t.Type == "timer" {
+		if t.After == "" && t.Delay == "" {
+			errs = append(errs, fmt.Errorf("Timer trigger requires one of 'after' or 'delay'"))
+		} else if t.After != "" && t.Delay != "" {
+			errs = append(errs, fmt.Errorf("Timer trigger can't have both 'after' and 'delay'"))
+		}
+
+		checkTag()
+
+		if t.Post != "" {
+			_, ok := posts[t.Post]
+			if !ok {
+				errs = append(errs, fmt.Errorf("Unknown post '%s' in timer trigger", t.Post))
+			}
+		}
+	} else if t.Type == "flag" {
+		checkTag()
+	} else if t.Type == "first_blood" {
+		if t.Tag == "" {
+			errs = append(errs, fmt.Errorf("First blood trigger requires a 'tag'"))
+		}
+
+		checkTag()
+	} else if t.Type == "score" {
+		// Any value is fine
+	} else if t.Type == "rank" {
+		if t.Value <= 0 {
+			errs = append(errs, fmt.Errorf("Rank trigger requires a positive 'value'"))
+		}
+	} else if t.Type == "rank_change" {
+		if t.Value == 0 {
+			errs = append(errs, fmt.Errorf("Rank change trigger requires a non-zero 'value'"))
+		}
+
+		if t.WindowDuration <= 0 {
+			errs = append(errs, fmt.Errorf("Rank change trigger requires a positive 'window'"))
+		}
+	} else {
+		errs = append(errs, fmt.Errorf("Unknown trigger type: %s", t.Type))
+	}
+
+	return errs
+}
+
+func (t *postTrigger) match(team dbTeam, state *triggerState) bool {
+	if t.All != nil {
+		for _, child := range t.All {
+			if !child.match(team, state) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if t.Any != nil {
+		for _, child := range t.Any {
+			if child.match(team, state) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if t.Not != nil {
+		return !t.Not.match(team, state)
+	}
+
+	if t.Type == "timer" {
+		if t.Delay == "" {
+			// Same time for everyone
+			return t.AfterTime.Unix() <= time.Now().Unix()
+		}
+
+		// Relative to a team event
+		var anchor time.Time
+		var ok bool
+		if t.Tag != "" {
+			anchor, ok = state.flags[t.Tag][team.AskgodID]
+		} else {
+			anchor, ok = state.postTimes[team.AskgodID][t.Post]
+		}
+
+		if !ok {
+			// The event hasn't happened yet
+			return false
+		}
+
+		return anchor.Add(t.DelayDuration).Unix() <= time.Now().Unix()
+	} else if t.Type == "flag" {
+		if t.Tag == "" {
+			// Any flag will do
+			return state.scores[team.AskgodID] != 0
+		}
+
+		_, ok := state.flags[t.Tag][team.AskgodID]
+		return ok
+	} else if t.Type == "first_blood" {
+		// Only the first team to score the flag
+		first := int64(-1)
+		firstTime := time.Time{}
+		for teamID, ts := range state.flags[t.Tag] {
+			if first == -1 || ts.Before(firstTime) || (ts.Equal(firstTime) && teamID < first) {
+				first = teamID
+				firstTime = ts
+			}
+		}
+
+		return first == team.AskgodID
+	} else if t.Type == "score" {
+		return state.scores[team.AskgodID] >= t.Value
+	} else if t.Type == "rank" {
+		// Teams missing from the scoreboard don't have a rank
+		rank, ok := state.ranks[team.AskgodID]
+		if !ok {
+			return false
+		}
+
+		return rank <= t.Value
+	} else if t.Type == "rank_change" {
+		// Compare with the rank at the start of the window, both are needed
+		rank, ok := state.ranks[team.AskgodID]
+		if !ok {
+			return false
+		}
+
+		prevRank, ok := state.rankAt(team.AskgodID, time.Now().Add(-t.WindowDuration))
+		if !ok {
+			return false
+		}
+
+		// Positive values are places gained, negative ones places lost
+		if t.Value > 0 {
+			return prevRank-rank >= t.Value
+		}
+
+		return rank-prevRank >= -t.Value
+	}
+
+	return false
+}
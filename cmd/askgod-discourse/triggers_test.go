@@ -0,0 +1,186 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func parseTestTrigger(t *testing.T, content string) (*postTrigger, error) {
+	t.Helper()
+
+	trigger := postTrigger{}
+	err := yaml.UnmarshalStrict([]byte(content), &trigger)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal trigger: %v", err)
+	}
+
+	return &trigger, trigger.parse()
+}
+
+func TestTriggerParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{"flag", "type: flag\ntag: flag01", true},
+		{"absolute timer", "type: timer\nafter: 2020/01/02 15:04", true},
+		{"bad timestamp", "type: timer\nafter: 2020-01-02T15:04", false},
+		{"relative to flag", "type: timer\ndelay: 1h\ntag: flag01", true},
+		{"relative to post", "type: timer\ndelay: 30m\npost: example-topic", true},
+		{"relative to both", "type: timer\ndelay: 1h\ntag: flag01\npost: example-topic", false},
+		{"relative to nothing", "type: timer\ndelay: 1h", false},
+		{"bad delay", "type: timer\ndelay: soon\ntag: flag01", false},
+		{"delay on flag", "type: flag\ndelay: 1h\ntag: flag01", false},
+		{"rank change window", "type: rank_change\nvalue: 3\nwindow: 1h", true},
+		{"bad window", "type: rank_change\nvalue: 3\nwindow: soon", false},
+		{"window on rank", "type: rank\nvalue: 3\nwindow: 1h", false},
+		{"no kind", "tag: flag01", false},
+		{"two kinds", "type: flag\nnot:\n  type: flag", false},
+		{"all", "all:\n  - type: flag\n  - type: score\n    value: 10", true},
+		{"any", "any:\n  - type: rank\n    value: 1\n  - type: flag", true},
+		{"not", "not:\n  type: flag\n  tag: flag01", true},
+		{"empty child", "all:\n  - ", false},
+		{"bad child", "any:\n  - type: flag\n  - tag: flag01", false},
+		{"bad grandchild", "not:\n  all:\n    - type: timer\n      delay: 1h", false},
+	}
+
+	for _, test := range tests {
+		_, err := parseTestTrigger(t, test.content)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestTriggerParseConversions(t *testing.T) {
+	trigger, err := parseTestTrigger(t, "all:\n  - type: timer\n    after: 2020/01/02 15:04\n  - type: timer\n    delay: 90m\n    tag: flag01")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	after := time.Date(2020, 1, 2, 15, 4, 0, 0, time.Local)
+	if !trigger.All[0].AfterTime.Equal(after) {
+		t.Errorf("Expected after time %v, got %v", after, trigger.All[0].AfterTime)
+	}
+
+	if trigger.All[1].DelayDuration != 90*time.Minute {
+		t.Errorf("Expected a 90m delay, got %v", trigger.All[1].DelayDuration)
+	}
+}
+
+func TestTriggerValidate(t *testing.T) {
+	posts := map[string]post{"example-topic": {}}
+	flags := map[string]map[int64]time.Time{"flag01": {}}
+
+	tests := []struct {
+		name    string
+		content string
+		errors  int
+	}{
+		{"known flag", "type: flag\ntag: flag01", 0},
+		{"any flag", "type: flag", 0},
+		{"unknown flag", "type: flag\ntag: flag99", 1},
+		{"timer without time", "type: timer", 1},
+		{"relative to unknown post", "type: timer\ndelay: 1h\npost: missing", 1},
+		{"relative to unknown flag", "type: timer\ndelay: 1h\ntag: flag99", 1},
+		{"first blood", "type: first_blood\ntag: flag01", 0},
+		{"first blood without tag", "type: first_blood", 1},
+		{"score", "type: score\nvalue: 100", 0},
+		{"rank", "type: rank\nvalue: 10", 0},
+		{"rank without value", "type: rank", 1},
+		{"rank change up", "type: rank_change\nvalue: 3\nwindow: 1h", 0},
+		{"rank change down", "type: rank_change\nvalue: -3\nwindow: 1h", 0},
+		{"rank change without value", "type: rank_change\nwindow: 1h", 1},
+		{"rank change without window", "type: rank_change\nvalue: 3", 1},
+		{"unknown type", "type: moon_phase", 1},
+		{"nested", "all:\n  - type: flag\n    tag: flag99\n  - not:\n      type: rank", 2},
+	}
+
+	for _, test := range tests {
+		trigger, err := parseTestTrigger(t, test.content)
+		if err != nil {
+			t.Errorf("%s: unexpected parse error: %v", test.name, err)
+			continue
+		}
+
+		errs := trigger.validate(posts, flags)
+		if len(errs) != test.errors {
+			t.Errorf("%s: expected %d errors, got %v", test.name, test.errors, errs)
+		}
+	}
+}
+
+func TestTriggerMatch(t *testing.T) {
+	now := time.Now()
+
+	state := &triggerState{
+		flags: map[string]map[int64]time.Time{
+			// Team 1 and 3 tied, team 2 later
+			"flag01": {1: now.Add(-time.Hour), 2: now.Add(-time.Minute), 3: now.Add(-time.Hour)},
+			"flag02": {2: now.Add(-10 * time.Minute)},
+		},
+		scores: map[int64]int64{1: 300, 2: 300, 3: 100},
+		ranks:  map[int64]int64{1: 1, 2: 1, 3: 3},
+		rankHistory: map[int64][]rankRecord{
+			// Team 1 climbed gradually, team 3 dropped recently
+			1: {{4, now.Add(-2 * time.Hour)}, {3, now.Add(-30 * time.Minute)}, {1, now.Add(-10 * time.Minute)}},
+			2: {{1, now.Add(-2 * time.Hour)}},
+			3: {{2, now.Add(-2 * time.Hour)}, {3, now.Add(-5 * time.Minute)}},
+		},
+		postTimes: map[int64]map[string]time.Time{
+			1: {"example-topic": now.Add(-2 * time.Hour)},
+			2: {"example-topic": now.Add(-time.Minute)},
+		},
+	}
+
+	past := now.Add(-time.Hour).Format("2006/01/02 15:04")
+	future := now.Add(time.Hour).Format("2006/01/02 15:04")
+
+	tests := []struct {
+		name    string
+		content string
+		teams   map[int64]bool
+	}{
+		{"timer in the past", "type: timer\nafter: " + past, map[int64]bool{1: true, 2: true, 3: true, 4: true}},
+		{"timer in the future", "type: timer\nafter: " + future, map[int64]bool{}},
+		{"delay after flag", "type: timer\ndelay: 30m\ntag: flag01", map[int64]bool{1: true, 3: true}},
+		{"delay after post", "type: timer\ndelay: 1h\npost: example-topic", map[int64]bool{1: true}},
+		{"specific flag", "type: flag\ntag: flag02", map[int64]bool{2: true}},
+		{"any flag", "type: flag", map[int64]bool{1: true, 2: true, 3: true}},
+		{"first blood tie goes to lowest ID", "type: first_blood\ntag: flag01", map[int64]bool{1: true}},
+		{"first blood single team", "type: first_blood\ntag: flag02", map[int64]bool{2: true}},
+		{"first blood unsolved", "type: first_blood\ntag: flag03", map[int64]bool{}},
+		{"score", "type: score\nvalue: 300", map[int64]bool{1: true, 2: true}},
+		{"rank ties share first place", "type: rank\nvalue: 1", map[int64]bool{1: true, 2: true}},
+		{"rank excludes unranked teams", "type: rank\nvalue: 100", map[int64]bool{1: true, 2: true, 3: true}},
+		{"rank gained over the window", "type: rank_change\nvalue: 3\nwindow: 1h", map[int64]bool{1: true}},
+		{"rank gained outside the window", "type: rank_change\nvalue: 3\nwindow: 20m", map[int64]bool{}},
+		{"rank window before the history", "type: rank_change\nvalue: 3\nwindow: 24h", map[int64]bool{1: true}},
+		{"rank lost", "type: rank_change\nvalue: -1\nwindow: 1h", map[int64]bool{3: true}},
+		{"rank lost too little", "type: rank_change\nvalue: -2\nwindow: 1h", map[int64]bool{}},
+		{"all", "all:\n  - type: flag\n    tag: flag01\n  - type: score\n    value: 300", map[int64]bool{1: true, 2: true}},
+		{"any", "any:\n  - type: flag\n    tag: flag02\n  - type: rank\n    value: 3", map[int64]bool{1: true, 2: true, 3: true}},
+		{"not", "not:\n  type: flag\n  tag: flag01", map[int64]bool{4: true}},
+		{"nested", "all:\n  - type: flag\n  - not:\n      any:\n        - type: flag\n          tag: flag02\n        - type: first_blood\n          tag: flag01", map[int64]bool{3: true}},
+	}
+
+	for _, test := range tests {
+		trigger, err := parseTestTrigger(t, test.content)
+		if err != nil {
+			t.Errorf("%s: unexpected parse error: %v", test.name, err)
+			continue
+		}
+
+		for teamID := int64(1); teamID <= 4; teamID++ {
+			team := dbTeam{AskgodID: teamID}
+			if trigger.match(team, state) != test.teams[teamID] {
+				t.Errorf("%s: expected %v for team %d", test.name, test.teams[teamID], teamID)
+			}
+		}
+	}
+}
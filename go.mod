@@ -10,6 +10,7 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.12
 	github.com/nsec/askgod v0.0.0-20220427021641-f0b2a15e2395
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.12.1
 	github.com/urfave/cli/v2 v2.5.0
 	gopkg.in/yaml.v2 v2.4.0
 )